@@ -4,13 +4,23 @@ import (
 	"flag"
 	log "github.com/Sirupsen/logrus"
 	"github.com/fsouza/go-dockerclient"
-	"github.com/schibsted/mesos2iam/iptables"
+	"github.com/schibsted/mesos2iam/firewall"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 )
 
 func main() {
 	server := NewServer()
-	parseFlags(server)
+
+	if len(os.Args) > 1 && os.Args[1] == "iptables" {
+		runIPTablesCommand(server, os.Args[2:])
+		return
+	}
+
+	parseFlags(server, os.Args[1:])
 
 	if server.HostIp == "" {
 		log.Panic("HostIp can't be empty")
@@ -18,10 +28,32 @@ func main() {
 
 	setLogLevel(server.Verbose)
 
+	if server.EC2MetadataBlock != "off" && !server.AddIPTablesRule {
+		log.Panic("-ec2-metadata-block requires -iptables")
+	}
+
+	// Containers blocked from the real metadata service get the credentials of their job from mesos2iam, which
+	// only proxies the metadata harmless to share with them, never the credentials nor the user data of the host
+	if server.EC2MetadataBlock == "redirect" {
+		server.EC2Metadata = true
+	}
+
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		log.Infof("Received %s, shutting down", <-signals)
+		close(stop)
+	}()
+
+	var rules firewall.Rules
+	var reconciled <-chan struct{}
 	if server.AddIPTablesRule {
-		if err := iptables.AddRules(server.AppPort, server.AwsContainerCredentialsIp, server.HostIp); err != nil {
+		rules = newFirewallRules(server)
+		if err := rules.Apply(); err != nil {
 			log.Fatal(err)
 		}
+		reconciled = firewall.StartReconciling(rules, server.IPTablesReconcileInterval, stop)
 	}
 
 	dockerClient, err := docker.NewClientFromEnv()
@@ -29,16 +61,65 @@ func main() {
 		log.Panic(err)
 	}
 
-	server.Run(dockerClient)
+	server.Run(dockerClient, stop)
+
+	if rules != nil {
+		// A reconciliation still running would restore the rules after they are deleted
+		<-reconciled
+		if err := rules.Delete(); err != nil {
+			log.Fatal(err)
+		}
+		log.Info("Removed firewall rules")
+	}
 }
 
-func parseFlags(server *Server) {
+// runIPTablesCommand runs "mesos2iam iptables clean [flags]", which removes the rules left by a mesos2iam
+// started with the same flags that didn't shut down cleanly, with the firewall backend selected by -firewall
+func runIPTablesCommand(server *Server, args []string) {
+	if len(args) == 0 || args[0] != "clean" {
+		log.Fatal("Usage: mesos2iam iptables clean [flags]")
+	}
+
+	parseFlags(server, args[1:])
+	setLogLevel(server.Verbose)
+
+	if server.HostIp == "" {
+		log.Fatal("HostIp can't be empty")
+	}
+
+	// The EC2 metadata rule is removed even without -ec2-metadata, it may have been added by a previous run
+	server.EC2Metadata = true
+	if err := newFirewallRules(server).Clean(); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Info("Removed firewall rules")
+}
+
+func newFirewallRules(server *Server) firewall.Rules {
+	rules, err := server.FirewallRules()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return rules
+}
+
+func parseFlags(server *Server, args []string) {
 	flag.BoolVar(&server.Verbose, "verbose", false, "Enable verbosity")
-	flag.BoolVar(&server.AddIPTablesRule, "iptables", false, "Add iptables rule (also requires --host-ip)")
+	flag.BoolVar(&server.AddIPTablesRule, "iptables", false, "Add firewall rules (also requires --host-ip)")
+	flag.StringVar(&server.Firewall, "firewall", getFromEnvOrDefault("MESOS2IAM_FIREWALL", DEFAULT_FIREWALL),
+		"Firewall backend of the rules: iptables, nftables or auto (nftables on hosts without a legacy iptables)")
+	flag.DurationVar(&server.IPTablesReconcileInterval,
+		"iptables-reconcile-interval",
+		getDurationFromEnvOrDefault("MESOS2IAM_IPTABLES_RECONCILE_INTERVAL", DEFAULT_IPTABLES_RECONCILE_INTERVAL),
+		"Interval between the checks restoring the firewall rules removed or moved by other programs")
 	flag.StringVar(&server.ListeningIp, "listening-ip", getFromEnvOrDefault("MESOS2IAM_LISTENING_IP", DEFAULT_LISTENING_IP),
 		"Listening IP address")
 	flag.StringVar(&server.HostIp, "host-ip", getFromEnvOrDefault("MESOS2IAM_HOST_IP", ""),
 		"Listening IP address")
+	flag.StringVar(&server.HostIpv6, "host-ipv6", getFromEnvOrDefault("MESOS2IAM_HOST_IPV6", ""),
+		"IPv6 address of the host the IPv6 requests are redirected to (required by -aws-container-credentials-ipv6)")
 	flag.StringVar(&server.AppPort, "app-port",
 		getFromEnvOrDefault("MESOS2IAM_SERVER_PORT", DEFAULT_SERVER_PORT),
 		"App port")
@@ -46,15 +127,166 @@ func parseFlags(server *Server) {
 	flag.StringVar(&server.AwsContainerCredentialsIp, "aws-container-credentials-ip",
 		getFromEnvOrDefault("MESOS2IAM_AWS_CONTAINER_CREDENTIALS_IP", DEFAULT_AWS_CONTAINER_CREDENTIALS_IP),
 		"IP address of aws container credentials host")
+	flag.StringVar(&server.AwsContainerCredentialsIpv6, "aws-container-credentials-ipv6",
+		getFromEnvOrDefault("MESOS2IAM_AWS_CONTAINER_CREDENTIALS_IPV6", ""),
+		"IPv6 address of aws container credentials host, redirected besides the IPv4 one when set")
+	flag.BoolVar(&server.EC2Metadata, "ec2-metadata", false, "Serve credentials through the EC2 metadata IAM endpoints too")
+	flag.StringVar(&server.EC2MetadataIp, "ec2-metadata-ip",
+		getFromEnvOrDefault("MESOS2IAM_EC2_METADATA_IP", DEFAULT_EC2_METADATA_IP),
+		"IP address of the EC2 instance metadata service")
+	flag.StringVar(&server.EC2MetadataIpv6, "ec2-metadata-ipv6",
+		getFromEnvOrDefault("MESOS2IAM_EC2_METADATA_IPV6", DEFAULT_EC2_METADATA_IPV6),
+		"IPv6 address of the EC2 instance metadata service, with -aws-container-credentials-ipv6")
+	flag.BoolVar(&server.EC2MetadataRequireToken, "ec2-metadata-require-token", false,
+		"Reject EC2 metadata requests without a valid IMDSv2 session token")
+	flag.StringVar(&server.EC2MetadataBlock, "ec2-metadata-block",
+		getFromEnvOrDefault("MESOS2IAM_EC2_METADATA_BLOCK", DEFAULT_EC2_METADATA_BLOCK),
+		"Container traffic to the real EC2 metadata service: off, drop, or redirect (serve the IAM endpoints and harmless metadata with -ec2-metadata, drop the rest)")
+	flag.StringVar(&server.EC2MetadataBlockIfaces, "ec2-metadata-block-interfaces",
+		getFromEnvOrDefault("MESOS2IAM_EC2_METADATA_BLOCK_INTERFACES", DEFAULT_EC2_METADATA_BLOCK_INTERFACES),
+		"Interfaces of the container networks blocked from the EC2 metadata service, separated by commas (+ is a wildcard)")
+	flag.StringVar(&server.EC2MetadataBlockCIDRs, "ec2-metadata-block-cidrs",
+		getFromEnvOrDefault("MESOS2IAM_EC2_METADATA_BLOCK_CIDRS", ""),
+		"CIDRs of the containers blocked from the EC2 metadata service, separated by commas")
 	flag.StringVar(&server.CredentialsURL,
 		"credentials-url",
 		getFromEnvOrDefault("MESOS2IAM_CREDENTIALS_URL", DEFAULT_CREDENTIALS_URL),
-		"Credentials Url")
+		"Credentials Url, or comma separated Urls of several credentials services")
+	flag.StringVar(&server.CredentialsBackendStrategy,
+		"credentials-backend-strategy",
+		getFromEnvOrDefault("MESOS2IAM_CREDENTIALS_BACKEND_STRATEGY", DEFAULT_CREDENTIALS_BACKEND_STRATEGY),
+		"Choice of the credentials service among the healthy ones: failover (in order) or round-robin")
+	flag.DurationVar(&server.CredentialsHealthCheckInterval,
+		"credentials-health-check-interval",
+		getDurationFromEnvOrDefault("MESOS2IAM_CREDENTIALS_HEALTH_CHECK_INTERVAL", DEFAULT_CREDENTIALS_HEALTH_CHECK_INTERVAL),
+		"Interval between the health checks of the credentials services")
+	flag.StringVar(&server.CredentialsTLSCert,
+		"credentials-tls-cert",
+		getFromEnvOrDefault("MESOS2IAM_CREDENTIALS_TLS_CERT", ""),
+		"PEM client certificate authenticating mesos2iam to the credentials services (requires -credentials-tls-key)")
+	flag.StringVar(&server.CredentialsTLSKey,
+		"credentials-tls-key",
+		getFromEnvOrDefault("MESOS2IAM_CREDENTIALS_TLS_KEY", ""),
+		"PEM key of the client certificate")
+	flag.StringVar(&server.CredentialsTLSCA,
+		"credentials-tls-ca",
+		getFromEnvOrDefault("MESOS2IAM_CREDENTIALS_TLS_CA", ""),
+		"PEM CA bundle verifying the credentials services instead of the system roots")
+	flag.StringVar(&server.CredentialsTLSServerName,
+		"credentials-tls-server-name",
+		getFromEnvOrDefault("MESOS2IAM_CREDENTIALS_TLS_SERVER_NAME", ""),
+		"Name expected in the certificate of the credentials services instead of the host of their Url")
+	flag.StringVar(&server.CredentialsTLSMinVersion,
+		"credentials-tls-min-version",
+		getFromEnvOrDefault("MESOS2IAM_CREDENTIALS_TLS_MIN_VERSION", DEFAULT_CREDENTIALS_TLS_MIN_VERSION),
+		"Minimum TLS version of the connections to the credentials services: 1.0, 1.1, 1.2 or 1.3")
+	flag.BoolVar(&server.CredentialsSigV4, "credentials-sigv4", false,
+		"Sign the requests to the credentials services with SigV4 using the instance credentials of the agent")
+	flag.StringVar(&server.CredentialsSigV4Service,
+		"credentials-sigv4-service",
+		getFromEnvOrDefault("MESOS2IAM_CREDENTIALS_SIGV4_SERVICE", DEFAULT_CREDENTIALS_SIGV4_SERVICE),
+		"Service name of the SigV4 signature of the requests to the credentials services")
+	flag.StringVar(&server.CredentialsProvider,
+		"credentials-provider",
+		getFromEnvOrDefault("MESOS2IAM_CREDENTIALS_PROVIDER", DEFAULT_CREDENTIALS_PROVIDER),
+		"Source of the credentials: url (request them to the credentials url) or sts (assume the roles through STS)")
 	flag.StringVar(&server.Mesos2IamPrefix,
 		"mesos-2-iam-prefix",
 		getFromEnvOrDefault("MESOS2IAM_PREFIX", DEFAULT_MESOS_2_IAM_PREFIX),
 		"Mesos2Iam prefix to parse the id to be sent to credentials url")
-	flag.Parse()
+	flag.StringVar(&server.JobIdSources,
+		"job-id-sources",
+		getFromEnvOrDefault("MESOS2IAM_JOB_ID_SOURCES", DEFAULT_JOB_ID_SOURCES),
+		"Comma separated places to read the job id from, by order of precedence: docker-label, mesos-label, env")
+	flag.StringVar(&server.JobIdLabel,
+		"job-id-label",
+		getFromEnvOrDefault("MESOS2IAM_JOB_ID_LABEL", DEFAULT_JOB_ID_LABEL),
+		"Docker label holding the job id")
+	flag.StringVar(&server.JobIdMesosLabel,
+		"job-id-mesos-label",
+		getFromEnvOrDefault("MESOS2IAM_JOB_ID_MESOS_LABEL", DEFAULT_JOB_ID_MESOS_LABEL),
+		"Mesos task label holding the job id")
+	flag.StringVar(&server.JobIdFormat,
+		"job-id-format",
+		getFromEnvOrDefault("MESOS2IAM_JOB_ID_FORMAT", DEFAULT_JOB_ID_FORMAT),
+		"Format of the job ids: uuidv4, uuid, regexp or allow-list")
+	flag.StringVar(&server.JobIdRegexp,
+		"job-id-regexp",
+		getFromEnvOrDefault("MESOS2IAM_JOB_ID_REGEXP", ""),
+		"Regular expression the job ids must fully match with -job-id-format=regexp")
+	flag.StringVar(&server.JobIdAllowList,
+		"job-id-allow-list",
+		getFromEnvOrDefault("MESOS2IAM_JOB_ID_ALLOW_LIST", ""),
+		"Comma separated job ids allowed with -job-id-format=allow-list")
+	flag.StringVar(&server.RoleMapping,
+		"role-mapping",
+		getFromEnvOrDefault("MESOS2IAM_ROLE_MAPPING", ""),
+		"YAML or JSON file with the roles every job may assume (default: any role)")
+	flag.StringVar(&server.Containerizers,
+		"containerizers",
+		getFromEnvOrDefault("MESOS2IAM_CONTAINERIZERS", DEFAULT_CONTAINERIZERS),
+		"Comma separated containerizers whose containers are looked up, in order: docker, mesos")
+	flag.StringVar(&server.MesosAgentURL,
+		"mesos-agent-url",
+		getFromEnvOrDefault("MESOS2IAM_MESOS_AGENT_URL", DEFAULT_MESOS_AGENT_URL),
+		"Url of the local Mesos agent, used to find the containers of the Mesos containerizer")
+	flag.StringVar(&server.AllowedNetworks,
+		"allowed-networks",
+		getFromEnvOrDefault("MESOS2IAM_ALLOWED_NETWORKS", ""),
+		"Comma separated Docker networks whose containers can request credentials (default: all)")
+	flag.BoolVar(&server.DockerIndex, "docker-index", false,
+		"Keep an in-memory index of the Docker containers updated from the Docker events")
+	flag.DurationVar(&server.DockerResyncInterval,
+		"docker-resync-interval",
+		getDurationFromEnvOrDefault("MESOS2IAM_DOCKER_RESYNC_INTERVAL", DEFAULT_DOCKER_RESYNC_INTERVAL),
+		"Interval between full resyncs of the Docker containers index")
+	flag.BoolVar(&server.CredentialsCache, "credentials-cache", true, "Cache credentials in memory until they expire")
+	flag.DurationVar(&server.CredentialsRefreshBefore,
+		"credentials-refresh-before",
+		getDurationFromEnvOrDefault("MESOS2IAM_CREDENTIALS_REFRESH_BEFORE", DEFAULT_CREDENTIALS_REFRESH_BEFORE),
+		"Refresh cached credentials this long before they expire")
+	flag.DurationVar(&server.CredentialsCacheIdle,
+		"credentials-cache-idle-timeout",
+		getDurationFromEnvOrDefault("MESOS2IAM_CREDENTIALS_CACHE_IDLE_TIMEOUT", DEFAULT_CREDENTIALS_CACHE_IDLE_TIMEOUT),
+		"Stop refreshing credentials of jobs that haven't requested them for this long")
+	flag.DurationVar(&server.CredentialsTimeout,
+		"credentials-timeout",
+		getDurationFromEnvOrDefault("MESOS2IAM_CREDENTIALS_TIMEOUT", DEFAULT_CREDENTIALS_TIMEOUT),
+		"Timeout of every attempt to get credentials from the backend")
+	flag.IntVar(&server.CredentialsRetries,
+		"credentials-retries",
+		getIntFromEnvOrDefault("MESOS2IAM_CREDENTIALS_RETRIES", DEFAULT_CREDENTIALS_RETRIES),
+		"Retries of the requests to the backend failing with a network error, a 429 or a 5xx")
+	flag.DurationVar(&server.CredentialsRetryBackoff,
+		"credentials-retry-backoff",
+		getDurationFromEnvOrDefault("MESOS2IAM_CREDENTIALS_RETRY_BACKOFF", DEFAULT_CREDENTIALS_RETRY_BACKOFF),
+		"Backoff before the first retry, doubled on every retry")
+	flag.DurationVar(&server.CredentialsRetryMax,
+		"credentials-retry-max-backoff",
+		getDurationFromEnvOrDefault("MESOS2IAM_CREDENTIALS_RETRY_MAX_BACKOFF", DEFAULT_CREDENTIALS_RETRY_MAX_BACKOFF),
+		"Maximum backoff between retries")
+	flag.IntVar(&server.CredentialsBreakerLimit,
+		"credentials-breaker-threshold",
+		getIntFromEnvOrDefault("MESOS2IAM_CREDENTIALS_BREAKER_THRESHOLD", DEFAULT_CREDENTIALS_BREAKER_THRESHOLD),
+		"Failed attempts in a row after which requests fail fast without calling the backend (0 to disable)")
+	flag.DurationVar(&server.CredentialsBreakerCooldown,
+		"credentials-breaker-cooldown",
+		getDurationFromEnvOrDefault("MESOS2IAM_CREDENTIALS_BREAKER_COOLDOWN", DEFAULT_CREDENTIALS_BREAKER_COOLDOWN),
+		"Interval between the requests probing the backend while the circuit breaker is open")
+	flag.StringVar(&server.STSRoleArnTemplate,
+		"sts-role-arn-template",
+		getFromEnvOrDefault("MESOS2IAM_STS_ROLE_ARN_TEMPLATE", ""),
+		"Template of the role ARN assumed through STS (e.g. arn:aws:iam::123456789012:role/{{.JobId}})")
+	flag.StringVar(&server.STSRoleTable,
+		"sts-role-table",
+		getFromEnvOrDefault("MESOS2IAM_STS_ROLE_TABLE", ""),
+		"JSON file with the role ARN assumed through STS for every JobId")
+	flag.DurationVar(&server.STSSessionDuration,
+		"sts-session-duration",
+		getDurationFromEnvOrDefault("MESOS2IAM_STS_SESSION_DURATION", DEFAULT_STS_SESSION_DURATION),
+		"Lifetime of the credentials obtained through STS")
+	flag.StringVar(&server.AwsRegion, "aws-region", getFromEnvOrDefault("AWS_REGION", "us-east-1"), "AWS region")
+	flag.CommandLine.Parse(args)
 }
 
 func setLogLevel(verbose bool) {
@@ -73,3 +305,28 @@ func getFromEnvOrDefault(variableName string, defaultValue string) string {
 
 	return value
 }
+
+func getDurationFromEnvOrDefault(variableName string, defaultValue string) time.Duration {
+	value := getFromEnvOrDefault(variableName, defaultValue)
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Panicf("Invalid duration \"%s\" in %s", value, variableName)
+	}
+
+	return duration
+}
+
+func getIntFromEnvOrDefault(variableName string, defaultValue int) int {
+	value := os.Getenv(variableName)
+	if value == "" {
+		return defaultValue
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		log.Panicf("Invalid number \"%s\" in %s", value, variableName)
+	}
+
+	return number
+}
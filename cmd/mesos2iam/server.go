@@ -1,11 +1,24 @@
 package main
 
 import (
+	"context"
 	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/fsouza/go-dockerclient"
+	"github.com/go-errors/errors"
+	"github.com/schibsted/mesos2iam/firewall"
 	http_pkg "github.com/schibsted/mesos2iam/http"
+	"github.com/schibsted/mesos2iam/iptables"
+	"github.com/schibsted/mesos2iam/metrics"
+	"github.com/schibsted/mesos2iam/nftables"
 	"github.com/schibsted/mesos2iam/pkg"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 )
 
@@ -13,55 +26,627 @@ var (
 	DEFAULT_LISTENING_IP                 = "0.0.0.0"
 	DEFAULT_SERVER_PORT                  = "51679"
 	DEFAULT_AWS_CONTAINER_CREDENTIALS_IP = "169.254.170.2"
+	DEFAULT_EC2_METADATA_IP              = "169.254.169.254"
+	// IPv6 address of the EC2 instance metadata service, on Nitro instances
+	DEFAULT_EC2_METADATA_IPV6 = "fd00:ec2::254"
+	// Traffic of the containers to the real EC2 metadata service: off (allowed), drop or redirect (to mesos2iam)
+	DEFAULT_EC2_METADATA_BLOCK = "off"
+	// Interfaces of the container networks: the default bridge and the user-defined ones
+	DEFAULT_EC2_METADATA_BLOCK_INTERFACES = "docker0,br-+"
 	// A custom credentials repository for IAM roles
 	DEFAULT_CREDENTIALS_URL    = "http://127.0.0.1:8080"
 	DEFAULT_MESOS_2_IAM_PREFIX = "TARDIS_SCHID="
+	// Places the job id is read from, by order of precedence: docker-label, mesos-label and/or env
+	DEFAULT_JOB_ID_SOURCES     = "env"
+	DEFAULT_JOB_ID_LABEL       = "mesos2iam.job-id"
+	DEFAULT_JOB_ID_MESOS_LABEL = "mesos2iam.job-id"
+	// Format of the job ids: uuidv4, uuid, regexp or allow-list
+	DEFAULT_JOB_ID_FORMAT = "uuidv4"
+	// Service of the SigV4 signature of the requests to the credentials backend, e.g. of an API Gateway
+	DEFAULT_CREDENTIALS_SIGV4_SERVICE = "execute-api"
+	// Minimum TLS version of the connections to the credentials backend
+	DEFAULT_CREDENTIALS_TLS_MIN_VERSION = "1.2"
+	// The TLS certificate, key and CA bundle are checked for changes this often
+	TLS_RELOAD_INTERVAL = time.Second * 10
+	// The role mapping file is checked for changes this often
+	ROLE_MAPPING_RELOAD_INTERVAL = time.Second * 10
+	// Firewall backend of the rules: iptables, nftables or auto
+	DEFAULT_FIREWALL = "auto"
+	// The firewall rules are checked and restored this often
+	DEFAULT_IPTABLES_RECONCILE_INTERVAL = "30s"
+	// Time given to the requests in progress to finish when shutting down
+	SHUTDOWN_TIMEOUT = time.Second * 10
+	// Cached credentials are refreshed this long before they expire
+	DEFAULT_CREDENTIALS_REFRESH_BEFORE = "5m"
+	// Credentials of jobs not requesting them for this long are not refreshed anymore
+	DEFAULT_CREDENTIALS_CACHE_IDLE_TIMEOUT = "1h"
+	CREDENTIALS_CACHE_REFRESH_INTERVAL     = time.Second * 30
+	// Lifetime of the credentials obtained when assuming roles through STS
+	DEFAULT_STS_SESSION_DURATION = "1h"
+	// Timeout of every attempt to get credentials from the backend
+	DEFAULT_CREDENTIALS_TIMEOUT = "10s"
+	// Failed attempts are retried this many times, waiting an exponential backoff between them
+	DEFAULT_CREDENTIALS_RETRIES           = 2
+	DEFAULT_CREDENTIALS_RETRY_BACKOFF     = "100ms"
+	DEFAULT_CREDENTIALS_RETRY_MAX_BACKOFF = "2s"
+	// The backend is considered down after this many failed attempts in a row (0 disables the circuit breaker)
+	// and only probed every cooldown
+	DEFAULT_CREDENTIALS_BREAKER_THRESHOLD = 5
+	DEFAULT_CREDENTIALS_BREAKER_COOLDOWN  = "30s"
+	// Choice of the backend among the CredentialsURL ones: failover (first healthy one) or round-robin
+	DEFAULT_CREDENTIALS_BACKEND_STRATEGY = "failover"
+	// The backends are checked this often, removing them from the rotation or adding them back
+	DEFAULT_CREDENTIALS_HEALTH_CHECK_INTERVAL = "10s"
+	// Source of the credentials: "url" requests them to CredentialsURL, "sts" assumes the roles itself
+	DEFAULT_CREDENTIALS_PROVIDER = "url"
+	// Containerizers launching the tasks: docker and/or mesos
+	DEFAULT_CONTAINERIZERS  = "docker"
+	DEFAULT_MESOS_AGENT_URL = "http://127.0.0.1:5051"
+	// The Docker containers index is rebuilt from scratch this often, besides following the Docker events
+	DEFAULT_DOCKER_RESYNC_INTERVAL = "5m"
 )
 
 type Server struct {
-	ListeningIp               string
-	HostIp                    string
-	AppPort                   string
-	Verbose                   bool
-	AddIPTablesRule           bool
-	AwsContainerCredentialsIp string
-	CredentialsURL            string
-	Mesos2IamPrefix           string
+	ListeningIp                    string
+	HostIp                         string
+	HostIpv6                       string
+	AppPort                        string
+	Verbose                        bool
+	AddIPTablesRule                bool
+	Firewall                       string
+	IPTablesReconcileInterval      time.Duration
+	AwsContainerCredentialsIp      string
+	AwsContainerCredentialsIpv6    string
+	EC2Metadata                    bool
+	EC2MetadataIp                  string
+	EC2MetadataIpv6                string
+	EC2MetadataRequireToken        bool
+	EC2MetadataBlock               string
+	EC2MetadataBlockIfaces         string
+	EC2MetadataBlockCIDRs          string
+	CredentialsURL                 string
+	CredentialsProvider            string
+	CredentialsBackendStrategy     string
+	CredentialsTLSCert             string
+	CredentialsTLSKey              string
+	CredentialsTLSCA               string
+	CredentialsTLSServerName       string
+	CredentialsTLSMinVersion       string
+	CredentialsSigV4               bool
+	CredentialsSigV4Service        string
+	CredentialsHealthCheckInterval time.Duration
+	CredentialsTimeout             time.Duration
+	CredentialsRetries             int
+	CredentialsRetryBackoff        time.Duration
+	CredentialsRetryMax            time.Duration
+	CredentialsBreakerLimit        int
+	CredentialsBreakerCooldown     time.Duration
+	Mesos2IamPrefix                string
+	JobIdSources                   string
+	JobIdLabel                     string
+	JobIdMesosLabel                string
+	JobIdFormat                    string
+	JobIdRegexp                    string
+	JobIdAllowList                 string
+	RoleMapping                    string
+	Containerizers                 string
+	MesosAgentURL                  string
+	DockerIndex                    bool
+	AllowedNetworks                string
+	DockerResyncInterval           time.Duration
+	CredentialsCache               bool
+	CredentialsRefreshBefore       time.Duration
+	CredentialsCacheIdle           time.Duration
+	STSRoleArnTemplate             string
+	STSRoleTable                   string
+	STSSessionDuration             time.Duration
+	AwsRegion                      string
+}
+
+// ipFamily holds the addresses of the rules of an IP family
+type ipFamily struct {
+	ipv6          bool
+	hostIp        string
+	credentialsIp string
+	ec2MetadataIp string
+}
+
+// ipFamilies returns the families the requests are redirected in: IPv4, and IPv6 too when the IPv6
+// credentials address is set
+func (s *Server) ipFamilies() ([]ipFamily, error) {
+	families := []ipFamily{{false, s.HostIp, s.AwsContainerCredentialsIp, s.EC2MetadataIp}}
+	if s.AwsContainerCredentialsIpv6 == "" {
+		return families, nil
+	}
+
+	if s.HostIpv6 == "" {
+		return nil, errors.New("-aws-container-credentials-ipv6 requires -host-ipv6")
+	}
+
+	return append(families, ipFamily{true, s.HostIpv6, s.AwsContainerCredentialsIpv6, s.EC2MetadataIpv6}), nil
+}
+
+// hostIps returns the addresses of the host processes requesting credentials
+func (s *Server) hostIps() []string {
+	if s.HostIpv6 == "" {
+		return []string{s.HostIp}
+	}
+
+	return []string{s.HostIp, s.HostIpv6}
+}
+
+// requestAddresses returns the addresses processes connect to when they request credentials: the address
+// mesos2iam listens to and the addresses redirected to it
+func (s *Server) requestAddresses() []string {
+	addresses := []string{}
+	for _, hostIp := range s.hostIps() {
+		addresses = append(addresses, net.JoinHostPort(hostIp, s.AppPort))
+	}
+	if ip := net.ParseIP(s.ListeningIp); ip != nil && !ip.IsUnspecified() && !ip.Equal(net.ParseIP(s.HostIp)) {
+		addresses = append(addresses, net.JoinHostPort(s.ListeningIp, s.AppPort))
+	}
+
+	addresses = append(addresses, net.JoinHostPort(s.AwsContainerCredentialsIp, "80"))
+	if s.AwsContainerCredentialsIpv6 != "" {
+		addresses = append(addresses, net.JoinHostPort(s.AwsContainerCredentialsIpv6, "80"))
+	}
+	if s.EC2Metadata {
+		addresses = append(addresses, net.JoinHostPort(s.EC2MetadataIp, "80"))
+		if s.AwsContainerCredentialsIpv6 != "" && s.EC2MetadataIpv6 != "" {
+			addresses = append(addresses, net.JoinHostPort(s.EC2MetadataIpv6, "80"))
+		}
+	}
+
+	return addresses
 }
 
 func (s *Server) BuildSecurityRequestHandler(dockerClient *docker.Client, credentialsURL string) *http_pkg.SecurityRequestHandler {
-	containerRepository := pkg.NewContainerRepository(dockerClient, s.Mesos2IamPrefix)
-	pidFinder := pkg.NewPidFinder()
+	validator := s.buildJobIdValidator()
+	jobIds := s.buildJobIdResolver(validator)
+	containerRepository := s.buildContainerRepository(dockerClient, jobIds)
+	pidFinder, err := pkg.NewProcPidFinder(s.hostIps(), s.requestAddresses())
+	if err != nil {
+		log.Panic(err)
+	}
+
+	jobFinder := pkg.NewJobFinder(containerRepository, pidFinder, s.hostIps(), jobIds)
+
+	handler := http_pkg.NewSecurityRequestHandler(jobFinder, s.buildCredentialsProvider(credentialsURL), validator)
+
+	if s.CredentialsCache {
+		cache := handler.EnableCache(s.CredentialsRefreshBefore, s.CredentialsCacheIdle)
+		cache.Start(CREDENTIALS_CACHE_REFRESH_INTERVAL, make(chan struct{}))
+	}
 
-	jobFinder := pkg.NewJobFinder(containerRepository, pidFinder, s.HostIp, s.Mesos2IamPrefix)
+	if s.RoleMapping != "" {
+		mapping, err := pkg.NewRoleMappingFromFile(s.RoleMapping)
+		if err != nil {
+			log.Panic(err)
+		}
 
-	netClient := &http.Client{
-		Timeout: time.Second * 10,
+		mapping.Start(ROLE_MAPPING_RELOAD_INTERVAL, make(chan struct{}))
+		handler.EnableRoleMapping(mapping)
 	}
-	return http_pkg.NewSecurityRequestHandler(jobFinder, netClient, credentialsURL, s.Mesos2IamPrefix)
+
+	return handler
+}
+
+func (s *Server) buildJobIdValidator() pkg.JobIdValidator {
+	switch s.JobIdFormat {
+	case "uuidv4":
+		return pkg.NewUUIDv4JobIdValidator()
+	case "uuid":
+		return pkg.NewUUIDJobIdValidator()
+	case "regexp":
+		validator, err := pkg.NewRegexpJobIdValidator(s.JobIdRegexp)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		return validator
+	case "allow-list":
+		return pkg.NewAllowListJobIdValidator(splitList(s.JobIdAllowList))
+	default:
+		log.Panicf("Unknown job id format \"%s\"", s.JobIdFormat)
+	}
+
+	return nil
 }
 
-func (s *Server) Run(dockerClient *docker.Client) {
+func (s *Server) buildJobIdResolver(validator pkg.JobIdValidator) *pkg.JobIdResolver {
+	sources := []pkg.JobIdSource{}
+	for _, source := range splitList(s.JobIdSources) {
+		switch source {
+		case "docker-label":
+			sources = append(sources, pkg.NewDockerLabelJobIdSource(s.JobIdLabel))
+		case "mesos-label":
+			sources = append(sources, pkg.NewMesosLabelJobIdSource(s.JobIdMesosLabel))
+		case "env":
+			sources = append(sources, pkg.NewEnvJobIdSource(s.Mesos2IamPrefix))
+		default:
+			log.Panicf("Unknown job id source \"%s\"", source)
+		}
+	}
+
+	if len(sources) == 0 {
+		log.Panic("At least one job id source is required")
+	}
+
+	return pkg.NewJobIdResolver(validator, sources...)
+}
+
+func (s *Server) buildContainerRepository(dockerClient *docker.Client, jobIds *pkg.JobIdResolver) pkg.ContainerRepository {
+	repositories := []pkg.ContainerRepository{}
+	for _, containerizer := range splitList(s.Containerizers) {
+		switch containerizer {
+		case "docker":
+			repository := s.buildDockerContainerRepository(dockerClient, jobIds)
+			// The frameworks of Docker containers are only used by the role mapping, and come from the agent
+			if s.RoleMapping != "" {
+				repository = pkg.NewDockerFrameworkRepository(repository, pkg.NewMesosContainerRepository(s.MesosAgentURL))
+			}
+			repositories = append(repositories, repository)
+		case "mesos":
+			log.Info("Looking for Mesos containers in ", s.MesosAgentURL)
+			repositories = append(repositories, pkg.NewMesosContainerRepository(s.MesosAgentURL))
+		default:
+			log.Panicf("Unknown containerizer \"%s\"", containerizer)
+		}
+	}
+
+	if len(repositories) == 1 {
+		return repositories[0]
+	}
+
+	return pkg.NewChainContainerRepository(repositories...)
+}
+
+func (s *Server) buildDockerContainerRepository(dockerClient *docker.Client, jobIds *pkg.JobIdResolver) pkg.ContainerRepository {
+	allowedNetworks := splitList(s.AllowedNetworks)
+	if len(allowedNetworks) > 0 {
+		log.Info("Only containers in these networks can request credentials: ", strings.Join(allowedNetworks, ", "))
+	}
+
+	if !s.DockerIndex {
+		return pkg.NewContainerRepository(dockerClient, allowedNetworks)
+	}
+
+	index := pkg.NewDockerContainerIndex(dockerClient, jobIds, allowedNetworks)
+	if err := index.Start(s.DockerResyncInterval, make(chan struct{})); err != nil {
+		log.Panic(err)
+	}
+
+	log.Info("Indexing Docker containers from the Docker events")
+	return index
+}
+
+func (s *Server) buildCredentialsProvider(credentialsURL string) http_pkg.CredentialsProvider {
+	var provider http_pkg.CredentialsProvider
+	switch s.CredentialsProvider {
+	case "url":
+		backends, err := http_pkg.NewBackendPool(splitList(credentialsURL), s.CredentialsBackendStrategy)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		log.Infof("Requesting credentials to %s (%s)", strings.Join(backends.URLs(), ", "), s.CredentialsBackendStrategy)
+		tlsConfig, err := http_pkg.NewTLSConfigLoader(s.CredentialsTLSCert, s.CredentialsTLSKey, s.CredentialsTLSCA,
+			s.CredentialsTLSServerName, s.CredentialsTLSMinVersion)
+		if err != nil {
+			log.Panic(err)
+		}
+		tlsConfig.Start(TLS_RELOAD_INTERVAL, make(chan struct{}))
+
+		var transport http.RoundTripper = tlsConfig.Transport()
+		if s.CredentialsSigV4 {
+			transport = s.buildRequestSigner().RoundTripper(transport)
+		}
+
+		netClient := &http.Client{
+			Timeout:   s.CredentialsTimeout,
+			Transport: transport,
+		}
+		urlProvider := http_pkg.NewFailoverURLCredentialsProvider(netClient, backends)
+		urlProvider.StartHealthChecks(s.CredentialsHealthCheckInterval, make(chan struct{}))
+		provider = urlProvider
+	case "sts":
+		provider = s.buildSTSCredentialsProvider()
+	default:
+		log.Panicf("Unknown credentials provider \"%s\"", s.CredentialsProvider)
+	}
+
+	var breaker *http_pkg.CircuitBreaker
+	if s.CredentialsBreakerLimit > 0 {
+		breaker = http_pkg.NewCircuitBreaker(s.CredentialsBreakerLimit, s.CredentialsBreakerCooldown)
+	}
+
+	return http_pkg.NewRetryingCredentialsProvider(provider, s.CredentialsRetries, s.CredentialsRetryBackoff, s.CredentialsRetryMax, breaker)
+}
+
+// buildRequestSigner signs the requests to the credentials backend with the instance credentials of the agent,
+// identifying it with its instance id and host ip
+func (s *Server) buildRequestSigner() *http_pkg.RequestSigner {
+	awsSession, err := session.NewSession(&aws.Config{Region: aws.String(s.AwsRegion)})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	instanceId, err := ec2metadata.New(awsSession).GetMetadata("instance-id")
+	if err != nil {
+		log.Panic("Couldn't get the instance id of the agent: ", err)
+	}
+
+	log.Infof("Signing the requests to the credentials backend for %s in %s as %s", s.CredentialsSigV4Service, s.AwsRegion, instanceId)
+	return http_pkg.NewRequestSigner(awsSession.Config.Credentials, s.CredentialsSigV4Service, s.AwsRegion, map[string]string{
+		http_pkg.InstanceIdHeader: instanceId,
+		http_pkg.HostIpHeader:     s.HostIp,
+	})
+}
+
+func (s *Server) buildSTSCredentialsProvider() http_pkg.CredentialsProvider {
+	var resolver http_pkg.RoleArnResolver
+	var err error
+	switch {
+	case s.STSRoleTable != "":
+		resolver, err = http_pkg.NewTableRoleArnResolverFromFile(s.STSRoleTable)
+	case s.STSRoleArnTemplate != "":
+		resolver, err = http_pkg.NewTemplateRoleArnResolver(s.STSRoleArnTemplate)
+	default:
+		log.Panic("The sts credentials provider requires --sts-role-table or --sts-role-arn-template")
+	}
+	if err != nil {
+		log.Panic(err)
+	}
+
+	awsSession, err := session.NewSession(&aws.Config{
+		Region:     aws.String(s.AwsRegion),
+		HTTPClient: &http.Client{Timeout: s.CredentialsTimeout},
+		// Retries are done by the RetryingCredentialsProvider
+		MaxRetries: aws.Int(0),
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	log.Info("Assuming roles through STS in ", s.AwsRegion)
+	return http_pkg.NewSTSCredentialsProvider(sts.New(awsSession), resolver, s.STSSessionDuration)
+}
+
+// Run serves the requests until stop is closed, then waits for the requests in progress to finish.
+func (s *Server) Run(dockerClient *docker.Client, stop <-chan struct{}) {
 	credentialsRequestHandler := s.BuildSecurityRequestHandler(dockerClient, s.CredentialsURL)
 	http.Handle("/v2/credentials", http_pkg.LogHandler(credentialsRequestHandler))
+	http.Handle("/metrics", metrics.Handler())
+	http.Handle("/healthz", http_pkg.HealthHandler())
+	http.Handle("/readyz", s.buildReadinessHandler(dockerClient, credentialsRequestHandler))
 
-	serverAddr := s.ListeningIp + ":" + s.AppPort
+	if s.EC2Metadata {
+		metadataUrl := &url.URL{Scheme: "http", Host: s.EC2MetadataIp}
+		metadataRequestHandler := http_pkg.NewMetadataRequestHandler(credentialsRequestHandler, metadataUrl,
+			http_pkg.NewMetadataTokenStore(), s.EC2MetadataRequireToken)
+		http.Handle("/latest/", http_pkg.LogHandler(metadataRequestHandler))
+		log.Info("Emulating EC2 metadata IAM endpoints of ", s.EC2MetadataIp)
+	}
+
+	serverAddr := net.JoinHostPort(s.ListeningIp, s.AppPort)
 	log.Info("Listening on ", serverAddr)
 	log.Info("Host IP: ", s.HostIp)
-	log.Panic(http.ListenAndServe(serverAddr, nil))
+	if s.HostIpv6 != "" {
+		log.Info("Host IPv6: ", s.HostIpv6)
+	}
+
+	httpServer := &http.Server{Addr: serverAddr}
+	shutdown := make(chan struct{})
+	go func() {
+		<-stop
+		ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+		defer cancel()
+
+		if err := httpServer.Shutdown(ctx); err != nil {
+			log.Error("Couldn't finish the requests in progress: ", err)
+		}
+		close(shutdown)
+	}()
+
+	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		log.Panic(err)
+	}
+	<-shutdown
+}
+
+// FirewallRules returns the rules redirecting the requests of the containers to mesos2iam, in the firewall
+// backend selected by s.Firewall, for IPv4 and for IPv6 when the IPv6 credentials address is set
+func (s *Server) FirewallRules() (firewall.Rules, error) {
+	families, err := s.ipFamilies()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.checkMetadataBlockCIDRs(families); err != nil {
+		return nil, err
+	}
+
+	sets := firewall.RuleSets{}
+	for _, family := range families {
+		rules, err := s.familyFirewallRules(family)
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, rules)
+	}
+
+	return sets, nil
+}
+
+// familyFirewallRules returns the rules of the addresses of family
+func (s *Server) familyFirewallRules(family ipFamily) (firewall.Rules, error) {
+	ec2MetadataIp := ""
+	if s.EC2Metadata {
+		ec2MetadataIp = family.ec2MetadataIp
+	}
+
+	block, err := s.buildMetadataBlock(family)
+	if err != nil {
+		return nil, err
+	}
+
+	switch s.firewallBackend() {
+	case "iptables":
+		return iptables.NewRules(family.ipv6, s.AppPort, family.hostIp, family.credentialsIp, ec2MetadataIp, block)
+	case "nftables":
+		return nftables.NewRules(family.ipv6, s.AppPort, family.hostIp, family.credentialsIp, ec2MetadataIp, block)
+	}
+
+	return nil, errors.Errorf("Unknown firewall \"%s\", must be iptables, nftables or auto", s.Firewall)
+}
 
+// checkMetadataBlockCIDRs fails when a CIDR of the containers is invalid, or is IPv6 without IPv6 rules to
+// set it in
+func (s *Server) checkMetadataBlockCIDRs(families []ipFamily) error {
+	for _, cidr := range splitList(s.EC2MetadataBlockCIDRs) {
+		ip, _, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return errors.Errorf("Invalid EC2 metadata block CIDR \"%s\": %s", cidr, err)
+		}
+
+		if ip.To4() == nil && len(families) == 1 {
+			return errors.Errorf("EC2 metadata block CIDR %s is IPv6 and requires -aws-container-credentials-ipv6", cidr)
+		}
+	}
+
+	return nil
+}
+
+// buildMetadataBlock returns the sources of container traffic kept from reaching the real EC2 metadata
+// service in family, only the CIDRs of that family, or nil when it isn't blocked
+func (s *Server) buildMetadataBlock(family ipFamily) (*firewall.MetadataBlock, error) {
+	switch s.EC2MetadataBlock {
+	case "off":
+		return nil, nil
+	case "drop", "redirect":
+	default:
+		return nil, errors.Errorf("Unknown EC2 metadata block \"%s\", must be off, drop or redirect", s.EC2MetadataBlock)
+	}
+
+	block := &firewall.MetadataBlock{
+		Address:    family.ec2MetadataIp,
+		Interfaces: splitList(s.EC2MetadataBlockIfaces),
+		CIDRs:      []string{},
+	}
+	for _, cidr := range splitList(s.EC2MetadataBlockCIDRs) {
+		if ip, _, err := net.ParseCIDR(cidr); err == nil && (ip.To4() == nil) == family.ipv6 {
+			block.CIDRs = append(block.CIDRs, cidr)
+		}
+	}
+
+	if family.ipv6 && block.Address == "" {
+		return nil, errors.New("Blocking the EC2 metadata service over IPv6 requires -ec2-metadata-ipv6")
+	}
+
+	if len(block.Interfaces) == 0 && len(block.CIDRs) == 0 {
+		if family.ipv6 {
+			return nil, errors.New("Blocking the EC2 metadata service over IPv6 requires interfaces or IPv6 CIDRs of the containers")
+		}
+		return nil, errors.New("Blocking the EC2 metadata service requires interfaces or CIDRs of the containers")
+	}
+
+	return block, nil
+}
+
+// firewallBackend resolves auto to nftables on hosts having nft and no legacy iptables, where the iptables
+// command is missing or is the nf_tables variant, and to iptables otherwise
+func (s *Server) firewallBackend() string {
+	if s.Firewall != "auto" {
+		return s.Firewall
+	}
+
+	if nftables.Available() && !iptables.IsLegacy() {
+		return "nftables"
+	}
+
+	return "iptables"
+}
+
+// buildReadinessHandler checks the dependencies mesos2iam needs to serve credentials
+func (s *Server) buildReadinessHandler(dockerClient *docker.Client, credentialsRequestHandler *http_pkg.SecurityRequestHandler) http.Handler {
+	checks := []http_pkg.HealthCheck{}
+	for _, containerizer := range splitList(s.Containerizers) {
+		if containerizer == "docker" {
+			checks = append(checks, http_pkg.HealthCheck{Name: "docker", Check: dockerClient.Ping})
+		}
+	}
+
+	checks = append(checks, http_pkg.HealthCheck{Name: "credentials-backend", Check: credentialsRequestHandler.CheckBackend})
+
+	if s.AddIPTablesRule {
+		rules, err := s.FirewallRules()
+		if err != nil {
+			log.Panic(err)
+		}
+		checks = append(checks, http_pkg.HealthCheck{Name: "firewall", Check: rules.Check})
+	}
+
+	return http_pkg.NewReadinessHandler(checks...)
 }
 
 // NewServer will create a new Server with default values.
 func NewServer() *Server {
+	refreshBefore, _ := time.ParseDuration(DEFAULT_CREDENTIALS_REFRESH_BEFORE)
+	cacheIdle, _ := time.ParseDuration(DEFAULT_CREDENTIALS_CACHE_IDLE_TIMEOUT)
+	stsSessionDuration, _ := time.ParseDuration(DEFAULT_STS_SESSION_DURATION)
+	dockerResyncInterval, _ := time.ParseDuration(DEFAULT_DOCKER_RESYNC_INTERVAL)
+	iptablesReconcileInterval, _ := time.ParseDuration(DEFAULT_IPTABLES_RECONCILE_INTERVAL)
+	credentialsTimeout, _ := time.ParseDuration(DEFAULT_CREDENTIALS_TIMEOUT)
+	retryBackoff, _ := time.ParseDuration(DEFAULT_CREDENTIALS_RETRY_BACKOFF)
+	retryMaxBackoff, _ := time.ParseDuration(DEFAULT_CREDENTIALS_RETRY_MAX_BACKOFF)
+	breakerCooldown, _ := time.ParseDuration(DEFAULT_CREDENTIALS_BREAKER_COOLDOWN)
+	healthCheckInterval, _ := time.ParseDuration(DEFAULT_CREDENTIALS_HEALTH_CHECK_INTERVAL)
+
 	return &Server{
-		DEFAULT_LISTENING_IP,
-		"",
-		DEFAULT_SERVER_PORT,
-		false,
-		false,
-		DEFAULT_AWS_CONTAINER_CREDENTIALS_IP,
-		DEFAULT_CREDENTIALS_URL,
-		DEFAULT_MESOS_2_IAM_PREFIX,
+		ListeningIp:                    DEFAULT_LISTENING_IP,
+		AppPort:                        DEFAULT_SERVER_PORT,
+		IPTablesReconcileInterval:      iptablesReconcileInterval,
+		Firewall:                       DEFAULT_FIREWALL,
+		AwsContainerCredentialsIp:      DEFAULT_AWS_CONTAINER_CREDENTIALS_IP,
+		EC2MetadataIp:                  DEFAULT_EC2_METADATA_IP,
+		EC2MetadataIpv6:                DEFAULT_EC2_METADATA_IPV6,
+		EC2MetadataBlock:               DEFAULT_EC2_METADATA_BLOCK,
+		EC2MetadataBlockIfaces:         DEFAULT_EC2_METADATA_BLOCK_INTERFACES,
+		CredentialsURL:                 DEFAULT_CREDENTIALS_URL,
+		CredentialsProvider:            DEFAULT_CREDENTIALS_PROVIDER,
+		CredentialsTimeout:             credentialsTimeout,
+		CredentialsBackendStrategy:     DEFAULT_CREDENTIALS_BACKEND_STRATEGY,
+		CredentialsTLSMinVersion:       DEFAULT_CREDENTIALS_TLS_MIN_VERSION,
+		CredentialsSigV4Service:        DEFAULT_CREDENTIALS_SIGV4_SERVICE,
+		CredentialsHealthCheckInterval: healthCheckInterval,
+		CredentialsRetries:             DEFAULT_CREDENTIALS_RETRIES,
+		CredentialsRetryBackoff:        retryBackoff,
+		CredentialsRetryMax:            retryMaxBackoff,
+		CredentialsBreakerLimit:        DEFAULT_CREDENTIALS_BREAKER_THRESHOLD,
+		CredentialsBreakerCooldown:     breakerCooldown,
+		Mesos2IamPrefix:                DEFAULT_MESOS_2_IAM_PREFIX,
+		JobIdSources:                   DEFAULT_JOB_ID_SOURCES,
+		JobIdLabel:                     DEFAULT_JOB_ID_LABEL,
+		JobIdMesosLabel:                DEFAULT_JOB_ID_MESOS_LABEL,
+		JobIdFormat:                    DEFAULT_JOB_ID_FORMAT,
+		Containerizers:                 DEFAULT_CONTAINERIZERS,
+		MesosAgentURL:                  DEFAULT_MESOS_AGENT_URL,
+		DockerResyncInterval:           dockerResyncInterval,
+		CredentialsCache:               true,
+		CredentialsRefreshBefore:       refreshBefore,
+		CredentialsCacheIdle:           cacheIdle,
+		STSSessionDuration:             stsSessionDuration,
 	}
 }
+
+// splitList parses comma separated flag values, ignoring empty items
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
@@ -0,0 +1,181 @@
+// Package firewall defines the rules redirecting the requests of the containers to mesos2iam, implemented
+// by the iptables and nftables packages.
+package firewall
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/schibsted/mesos2iam/metrics"
+	"net"
+	"time"
+)
+
+var repairs = metrics.NewCounterVec("mesos2iam_firewall_repairs_total",
+	"Rules of mesos2iam found missing or misordered and restored, by firewall backend and chain", "backend", "chain")
+
+// Rules redirect the requests of containers in bridge mode to the credentials address, and optionally to the
+// EC2 instance metadata service, to mesos2iam, and the ones of host processes to the credentials address.
+type Rules interface {
+	// Apply creates the rules, replacing the ones left by a previous run
+	Apply() error
+	// Reconcile restores the rules removed or moved by other programs, returning the number of repairs
+	Reconcile() (int, error)
+	// Check fails when any rule is missing, and when it's misordered with the backends able to tell
+	Check() error
+	// Delete removes the rules created by Apply
+	Delete() error
+	// Clean removes the rules left by any version of mesos2iam
+	Clean() error
+}
+
+// StartReconciling reconciles the rules every interval until stop is closed. The returned channel is closed
+// once the reconciliation in progress, if any, is over, so the rules can be deleted without being restored.
+func StartReconciling(rules Rules, interval time.Duration, stop <-chan struct{}) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := rules.Reconcile(); err != nil {
+					log.Error("Couldn't reconcile firewall rules: ", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return done
+}
+
+// CountRepair counts a rule restored by Reconcile
+func CountRepair(backend, chain string) {
+	repairs.Inc(backend, chain)
+}
+
+// MetadataBlock keeps the containers from reaching the EC2 instance metadata service at Address, and getting
+// the credentials of the instance role of the agent. The traffic coming from the Interfaces of the container
+// networks, or from the CIDRs of the containers, is dropped unless it has been redirected to mesos2iam. Host
+// processes, mesos2iam included, aren't affected.
+type MetadataBlock struct {
+	Address    string
+	Interfaces []string
+	CIDRs      []string
+}
+
+// CheckFamily fails unless the addresses, and the CIDRs of block unless it's nil, are of the family of the
+// table the rules go into: requests can't be redirected from an IPv6 address to an IPv4 one or the other way
+// around. Empty addresses are ignored.
+func CheckFamily(ipv6 bool, block *MetadataBlock, addresses ...string) error {
+	if block != nil {
+		addresses = append(addresses, block.Address)
+	}
+
+	for _, address := range addresses {
+		if address == "" {
+			continue
+		}
+
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return fmt.Errorf("Invalid IP address \"%s\"", address)
+		}
+		if (ip.To4() == nil) != ipv6 {
+			return fmt.Errorf("%s address %s can't be set in the %s rules", familyName(!ipv6), address, familyName(ipv6))
+		}
+	}
+
+	if block == nil {
+		return nil
+	}
+
+	for _, cidr := range block.CIDRs {
+		ip, _, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("Invalid CIDR \"%s\": %s", cidr, err)
+		}
+		if (ip.To4() == nil) != ipv6 {
+			return fmt.Errorf("%s CIDR %s can't be set in the %s rules", familyName(!ipv6), cidr, familyName(ipv6))
+		}
+	}
+
+	return nil
+}
+
+func familyName(ipv6 bool) string {
+	if ipv6 {
+		return "IPv6"
+	}
+
+	return "IPv4"
+}
+
+// RuleSets are the rules of each IP family, IPv4 and IPv6, managed together
+type RuleSets []Rules
+
+var _ Rules = RuleSets{}
+
+// Apply creates the rules of every family
+func (sets RuleSets) Apply() error {
+	for _, rules := range sets {
+		if err := rules.Apply(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Reconcile restores the rules of every family, returning the total number of repairs
+func (sets RuleSets) Reconcile() (int, error) {
+	repaired := 0
+	for _, rules := range sets {
+		n, err := rules.Reconcile()
+		repaired += n
+		if err != nil {
+			return repaired, err
+		}
+	}
+
+	return repaired, nil
+}
+
+// Check fails when any rule of any family is missing, or misordered with the backends able to tell
+func (sets RuleSets) Check() error {
+	for _, rules := range sets {
+		if err := rules.Check(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete removes the rules of every family, even when the ones of another family can't be removed
+func (sets RuleSets) Delete() error {
+	var failed error
+	for _, rules := range sets {
+		if err := rules.Delete(); err != nil {
+			failed = err
+		}
+	}
+
+	return failed
+}
+
+// Clean removes the rules left by any version of mesos2iam in every family
+func (sets RuleSets) Clean() error {
+	var failed error
+	for _, rules := range sets {
+		if err := rules.Clean(); err != nil {
+			failed = err
+		}
+	}
+
+	return failed
+}
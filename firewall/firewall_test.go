@@ -0,0 +1,94 @@
+package firewall_test
+
+import (
+	"errors"
+	"github.com/schibsted/mesos2iam/firewall"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowRules records whether a reconciliation is running
+type slowRules struct {
+	firewall.Rules
+	mutex   sync.Mutex
+	running bool
+}
+
+func (r *slowRules) Reconcile() (int, error) {
+	r.setRunning(true)
+	time.Sleep(20 * time.Millisecond)
+	r.setRunning(false)
+	return 0, nil
+}
+
+func (r *slowRules) setRunning(running bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.running = running
+}
+
+func TestStartReconcilingWaitsForTheReconciliationInProgress(t *testing.T) {
+	rules := &slowRules{}
+	stop := make(chan struct{})
+	done := firewall.StartReconciling(rules, time.Millisecond, stop)
+
+	time.Sleep(5 * time.Millisecond)
+	close(stop)
+	<-done
+
+	rules.mutex.Lock()
+	defer rules.mutex.Unlock()
+	assert.False(t, rules.running)
+}
+
+func TestCheckFamilyRequiresAddressesAndCIDRsOfTheFamily(t *testing.T) {
+	block := &firewall.MetadataBlock{Address: "169.254.169.254", CIDRs: []string{"172.17.0.0/16"}}
+	assert.NoError(t, firewall.CheckFamily(false, block, "10.0.0.1", "169.254.170.2", ""))
+	assert.NoError(t, firewall.CheckFamily(true, nil, "fd00::1", "fd00:ec2::23"))
+
+	assert.EqualError(t, firewall.CheckFamily(true, nil, "fd00::1", "169.254.170.2", ""),
+		"IPv4 address 169.254.170.2 can't be set in the IPv6 rules")
+	assert.EqualError(t, firewall.CheckFamily(false, nil, "10.0.0.1", "metadata"), "Invalid IP address \"metadata\"")
+
+	block = &firewall.MetadataBlock{Address: "fd00:ec2::254", CIDRs: []string{"fd00:dead::/64", "172.17.0.0/16"}}
+	assert.EqualError(t, firewall.CheckFamily(true, block, "fd00::1"), "IPv4 CIDR 172.17.0.0/16 can't be set in the IPv6 rules")
+}
+
+// recordingRules records the calls to the rules of a family
+type recordingRules struct {
+	firewall.Rules
+	calls []string
+	err   error
+}
+
+func (r *recordingRules) Reconcile() (int, error) {
+	r.calls = append(r.calls, "reconcile")
+	return 1, r.err
+}
+
+func (r *recordingRules) Delete() error {
+	r.calls = append(r.calls, "delete")
+	return r.err
+}
+
+func TestRuleSetsReconcileEveryFamily(t *testing.T) {
+	ipv4, ipv6 := &recordingRules{}, &recordingRules{}
+
+	repaired, err := firewall.RuleSets{ipv4, ipv6}.Reconcile()
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, repaired)
+	assert.Equal(t, []string{"reconcile"}, ipv4.calls)
+	assert.Equal(t, []string{"reconcile"}, ipv6.calls)
+}
+
+func TestRuleSetsDeleteEveryFamilyDespiteErrors(t *testing.T) {
+	ipv4, ipv6 := &recordingRules{err: errors.New("iptables failed")}, &recordingRules{}
+
+	err := firewall.RuleSets{ipv4, ipv6}.Delete()
+
+	assert.EqualError(t, err, "iptables failed")
+	assert.Equal(t, []string{"delete"}, ipv6.calls)
+}
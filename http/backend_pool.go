@@ -0,0 +1,123 @@
+package http
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-errors/errors"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// FailoverStrategy sends the requests to the first healthy backend, in the order they were given
+	FailoverStrategy = "failover"
+	// RoundRobinStrategy spreads the requests across the healthy backends
+	RoundRobinStrategy = "round-robin"
+)
+
+// NewBackendPool keeps the health of the base URLs of the credentials service, choosing the backends of
+// every request with strategy.
+func NewBackendPool(urls []string, strategy string) (*BackendPool, error) {
+	if len(urls) == 0 {
+		return nil, errors.New("At least one credentials backend is required")
+	}
+
+	if strategy != FailoverStrategy && strategy != RoundRobinStrategy {
+		return nil, errors.Errorf("Unknown backend strategy \"%s\", must be %s or %s", strategy, FailoverStrategy, RoundRobinStrategy)
+	}
+
+	pool := &BackendPool{urls: urls, strategy: strategy, healthy: map[string]bool{}}
+	for _, url := range urls {
+		pool.healthy[url] = true
+		backendUp.Set(1, url)
+	}
+
+	return pool, nil
+}
+
+// BackendPool removes the backends failing a request or a health check from the rotation until they pass a
+// health check again.
+type BackendPool struct {
+	urls     []string
+	strategy string
+	next     uint32
+
+	mutex   sync.RWMutex
+	healthy map[string]bool
+}
+
+// Candidates returns the backends to try for a request, in order: the healthy ones, then the unhealthy ones
+// as a last resort so requests are still attempted when every backend is considered down.
+func (p *BackendPool) Candidates() []string {
+	start := 0
+	if p.strategy == RoundRobinStrategy {
+		start = int(atomic.AddUint32(&p.next, 1)-1) % len(p.urls)
+	}
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	healthy, unhealthy := []string{}, []string{}
+	for i := range p.urls {
+		url := p.urls[(start+i)%len(p.urls)]
+		if p.healthy[url] {
+			healthy = append(healthy, url)
+		} else {
+			unhealthy = append(unhealthy, url)
+		}
+	}
+
+	return append(healthy, unhealthy...)
+}
+
+// Healthy returns the backends in the rotation
+func (p *BackendPool) Healthy() []string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	healthy := []string{}
+	for _, url := range p.urls {
+		if p.healthy[url] {
+			healthy = append(healthy, url)
+		}
+	}
+
+	return healthy
+}
+
+// URLs returns every backend, healthy or not
+func (p *BackendPool) URLs() []string {
+	return p.urls
+}
+
+// MarkDown removes the backend from the rotation
+func (p *BackendPool) MarkDown(url string, err error) {
+	if p.setHealthy(url, false) {
+		log.Warnf("Credentials backend %s removed from the rotation: %s", url, err)
+	}
+}
+
+// MarkUp adds the backend back to the rotation
+func (p *BackendPool) MarkUp(url string) {
+	if p.setHealthy(url, true) {
+		log.Infof("Credentials backend %s added back to the rotation", url)
+	}
+}
+
+// setHealthy returns true when the health of the backend changed
+func (p *BackendPool) setHealthy(url string, healthy bool) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.healthy[url] == healthy {
+		return false
+	}
+
+	p.healthy[url] = healthy
+	if healthy {
+		backendUp.Set(1, url)
+	} else {
+		backendUp.Set(0, url)
+	}
+
+	return true
+}
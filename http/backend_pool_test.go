@@ -0,0 +1,78 @@
+package http_test
+
+import (
+	"encoding/json"
+	"github.com/aws/amazon-ecs-agent/agent/credentials"
+	"github.com/go-errors/errors"
+	http_pkg "github.com/schibsted/mesos2iam/http"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackendPoolFailover(t *testing.T) {
+	pool, err := http_pkg.NewBackendPool([]string{"http://a", "http://b", "http://c"}, http_pkg.FailoverStrategy)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"http://a", "http://b", "http://c"}, pool.Candidates())
+	assert.Equal(t, []string{"http://a", "http://b", "http://c"}, pool.Candidates())
+
+	pool.MarkDown("http://a", errors.New("timeout"))
+	assert.Equal(t, []string{"http://b", "http://c", "http://a"}, pool.Candidates())
+
+	pool.MarkUp("http://a")
+	assert.Equal(t, []string{"http://a", "http://b", "http://c"}, pool.Candidates())
+}
+
+func TestBackendPoolRoundRobin(t *testing.T) {
+	pool, err := http_pkg.NewBackendPool([]string{"http://a", "http://b"}, http_pkg.RoundRobinStrategy)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"http://a", "http://b"}, pool.Candidates())
+	assert.Equal(t, []string{"http://b", "http://a"}, pool.Candidates())
+
+	pool.MarkDown("http://a", errors.New("timeout"))
+	assert.Equal(t, []string{"http://b", "http://a"}, pool.Candidates())
+	assert.Equal(t, []string{"http://b", "http://a"}, pool.Candidates())
+}
+
+func TestBackendPoolRejectsUnknownStrategies(t *testing.T) {
+	_, err := http_pkg.NewBackendPool([]string{"http://a"}, "random")
+
+	assert.EqualError(t, err, "Unknown backend strategy \"random\", must be failover or round-robin")
+}
+
+func TestURLCredentialsProviderFailsOverToTheNextBackend(t *testing.T) {
+	var healthy int32
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(credentials.IAMRoleCredentials{RoleArn: "primary"})
+	}))
+	defer down.Close()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(credentials.IAMRoleCredentials{RoleArn: "secondary"})
+	}))
+	defer up.Close()
+
+	pool, _ := http_pkg.NewBackendPool([]string{down.URL, up.URL}, http_pkg.FailoverStrategy)
+	provider := http_pkg.NewFailoverURLCredentialsProvider(&http.Client{Timeout: time.Second}, pool)
+
+	creds, err := provider.GetCredentials("job")
+	assert.NoError(t, err)
+	assert.Equal(t, "secondary", creds.RoleArn)
+	assert.Equal(t, []string{up.URL, down.URL}, pool.Candidates())
+
+	atomic.StoreInt32(&healthy, 1)
+	assert.NoError(t, provider.CheckBackends())
+	assert.Equal(t, []string{down.URL, up.URL}, pool.Candidates())
+
+	creds, err = provider.GetCredentials("job")
+	assert.NoError(t, err)
+	assert.Equal(t, "primary", creds.RoleArn)
+}
@@ -0,0 +1,143 @@
+package http
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/amazon-ecs-agent/agent/credentials"
+	"sync"
+	"time"
+)
+
+// CredentialsFetchFunc retrieves fresh credentials for a job id from the credentials backend.
+type CredentialsFetchFunc func(jobId string) (*credentials.IAMRoleCredentials, error)
+
+// CredentialsCache keeps the credentials of every job in memory until they expire, refreshing them in the
+// background some time before the expiration so requests never wait for the backend while the cached ones
+// are still valid.
+type CredentialsCache struct {
+	fetch         CredentialsFetchFunc
+	refreshBefore time.Duration
+	idleTimeout   time.Duration
+
+	mutex   sync.Mutex
+	entries map[string]*credentialsCacheEntry
+}
+
+type credentialsCacheEntry struct {
+	credentials *credentials.IAMRoleCredentials
+	expiration  time.Time
+	lastAccess  time.Time
+}
+
+// NewCredentialsCache creates a cache that refreshes credentials refreshBefore their expiration and stops
+// refreshing the ones of jobs that haven't requested them for idleTimeout.
+func NewCredentialsCache(fetch CredentialsFetchFunc, refreshBefore, idleTimeout time.Duration) *CredentialsCache {
+	return &CredentialsCache{
+		fetch:         fetch,
+		refreshBefore: refreshBefore,
+		idleTimeout:   idleTimeout,
+		entries:       make(map[string]*credentialsCacheEntry),
+	}
+}
+
+// Get returns the cached credentials of the job while they are valid, otherwise fetches them from the backend.
+func (c *CredentialsCache) Get(jobId string) (*credentials.IAMRoleCredentials, error) {
+	c.mutex.Lock()
+	entry, ok := c.entries[jobId]
+	if ok && time.Now().Before(entry.expiration) {
+		entry.lastAccess = time.Now()
+		creds := *entry.credentials
+		c.mutex.Unlock()
+
+		cacheRequests.Inc("hit")
+		log.Debug("Credentials cache hit for JobId: ", jobId)
+		return &creds, nil
+	}
+	c.mutex.Unlock()
+
+	cacheRequests.Inc("miss")
+	log.Debug("Credentials cache miss for JobId: ", jobId)
+	creds, err := c.fetch(jobId)
+	if err != nil {
+		return nil, err
+	}
+
+	c.store(jobId, creds, true)
+	return creds, nil
+}
+
+// Start refreshes the credentials about to expire every interval until stop is closed.
+func (c *CredentialsCache) Start(interval time.Duration, stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				c.Refresh()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Refresh fetches again the credentials expiring within the refresh window and evicts the expired and idle ones.
+// When the backend fails the cached credentials are kept, so they keep being served until they expire.
+func (c *CredentialsCache) Refresh() {
+	for _, jobId := range c.jobsToRefresh() {
+		creds, err := c.fetch(jobId)
+		if err != nil {
+			log.Warnf("Couldn't refresh credentials for JobId %s, serving cached ones: %s", jobId, err)
+			continue
+		}
+
+		log.Debug("Credentials refreshed for JobId: ", jobId)
+		c.store(jobId, creds, false)
+	}
+}
+
+func (c *CredentialsCache) jobsToRefresh() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	jobIds := []string{}
+	for jobId, entry := range c.entries {
+		if !now.Before(entry.expiration) || now.Sub(entry.lastAccess) > c.idleTimeout {
+			log.Debug("Evicting credentials from cache for JobId: ", jobId)
+			delete(c.entries, jobId)
+			credentialsExpiration.Delete(jobId)
+			continue
+		}
+
+		if entry.expiration.Sub(now) <= c.refreshBefore {
+			jobIds = append(jobIds, jobId)
+		}
+	}
+
+	return jobIds
+}
+
+func (c *CredentialsCache) store(jobId string, creds *credentials.IAMRoleCredentials, accessed bool) {
+	expiration, err := time.Parse(time.RFC3339, creds.Expiration)
+	if err != nil {
+		log.Warnf("Not caching credentials for JobId %s, invalid expiration \"%s\"", jobId, creds.Expiration)
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	lastAccess := time.Now()
+	if entry, ok := c.entries[jobId]; ok && !accessed {
+		lastAccess = entry.lastAccess
+	}
+
+	cached := *creds
+	c.entries[jobId] = &credentialsCacheEntry{
+		credentials: &cached,
+		expiration:  expiration,
+		lastAccess:  lastAccess,
+	}
+}
@@ -0,0 +1,87 @@
+package http_test
+
+import (
+	"github.com/aws/amazon-ecs-agent/agent/credentials"
+	"github.com/go-errors/errors"
+	http_pkg "github.com/schibsted/mesos2iam/http"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+type fakeBackend struct {
+	calls      int
+	expiration time.Time
+	err        error
+}
+
+func (b *fakeBackend) fetch(jobId string) (*credentials.IAMRoleCredentials, error) {
+	b.calls++
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	return &credentials.IAMRoleCredentials{
+		RoleArn:     "roleArn",
+		AccessKeyID: "AccessKey",
+		Expiration:  b.expiration.UTC().Format(time.RFC3339),
+	}, nil
+}
+
+func TestCredentialsCacheServesCachedCredentials(t *testing.T) {
+	backend := &fakeBackend{expiration: time.Now().Add(time.Hour)}
+	cache := http_pkg.NewCredentialsCache(backend.fetch, 5*time.Minute, time.Hour)
+
+	for i := 0; i < 3; i++ {
+		creds, err := cache.Get("job")
+		assert.NoError(t, err)
+		assert.Equal(t, "AccessKey", creds.AccessKeyID)
+	}
+
+	assert.Equal(t, 1, backend.calls)
+}
+
+func TestCredentialsCacheRefreshesCredentialsAboutToExpire(t *testing.T) {
+	backend := &fakeBackend{expiration: time.Now().Add(time.Minute)}
+	cache := http_pkg.NewCredentialsCache(backend.fetch, 5*time.Minute, time.Hour)
+
+	_, err := cache.Get("job")
+	assert.NoError(t, err)
+
+	backend.expiration = time.Now().Add(time.Hour)
+	cache.Refresh()
+	assert.Equal(t, 2, backend.calls)
+
+	cache.Refresh()
+	assert.Equal(t, 2, backend.calls, "Fresh credentials should not be refreshed")
+}
+
+func TestCredentialsCacheServesStaleCredentialsWhenBackendIsDown(t *testing.T) {
+	backend := &fakeBackend{expiration: time.Now().Add(time.Minute)}
+	cache := http_pkg.NewCredentialsCache(backend.fetch, 5*time.Minute, time.Hour)
+
+	_, err := cache.Get("job")
+	assert.NoError(t, err)
+
+	backend.err = errors.New("backend is down")
+	cache.Refresh()
+
+	creds, err := cache.Get("job")
+	assert.NoError(t, err)
+	assert.Equal(t, "AccessKey", creds.AccessKeyID)
+	assert.Equal(t, 2, backend.calls)
+}
+
+func TestCredentialsCacheDoesNotCacheCredentialsWithoutValidExpiration(t *testing.T) {
+	backend := &fakeBackend{}
+	fetch := func(jobId string) (*credentials.IAMRoleCredentials, error) {
+		backend.calls++
+		return &credentials.IAMRoleCredentials{Expiration: "Expiration Date"}, nil
+	}
+	cache := http_pkg.NewCredentialsCache(fetch, 5*time.Minute, time.Hour)
+
+	cache.Get("job")
+	cache.Get("job")
+
+	assert.Equal(t, 2, backend.calls)
+}
@@ -0,0 +1,228 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/amazon-ecs-agent/agent/credentials"
+	"github.com/go-errors/errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// CredentialsProvider returns the IAM role credentials of a job.
+// Implementations return a *CredentialsNotFoundError when there are no credentials for the job, a
+// *CredentialsUnavailableError when the source of the credentials can't be reached and an
+// *InvalidCredentialsError when it answers with anything but credentials.
+type CredentialsProvider interface {
+	GetCredentials(jobId string) (*credentials.IAMRoleCredentials, error)
+}
+
+// BackendChecker is implemented by the credentials providers able to tell if their backend is reachable
+type BackendChecker interface {
+	CheckBackend() error
+}
+
+// CredentialsNotFoundError means the job doesn't have any role assigned.
+type CredentialsNotFoundError struct {
+	JobId string
+}
+
+func (e *CredentialsNotFoundError) Error() string {
+	return fmt.Sprintf("No credentials found for JobId %s", e.JobId)
+}
+
+// CredentialsUnavailableError means the credentials couldn't be retrieved, retrying later may succeed.
+type CredentialsUnavailableError struct {
+	Err error
+}
+
+func (e *CredentialsUnavailableError) Error() string {
+	return fmt.Sprintf("Credentials unavailable: %s", e.Err)
+}
+
+// InvalidCredentialsError means the backend answered with an unexpected status code, a body that isn't
+// credentials, or credentials that are incomplete or already expired.
+type InvalidCredentialsError struct {
+	Err error
+}
+
+func (e *InvalidCredentialsError) Error() string {
+	return fmt.Sprintf("Invalid credentials from backend: %s", e.Err)
+}
+
+// normalizeCredentials checks the credentials are complete and not expired, returning them with their
+// expiration in UTC, as served by the ECS agent
+func normalizeCredentials(creds *credentials.IAMRoleCredentials) (*credentials.IAMRoleCredentials, error) {
+	for field, value := range map[string]string{
+		"AccessKeyId":     creds.AccessKeyID,
+		"SecretAccessKey": creds.SecretAccessKey,
+		"Token":           creds.SessionToken,
+		"Expiration":      creds.Expiration,
+	} {
+		if value == "" {
+			return nil, &InvalidCredentialsError{errors.Errorf("missing %s", field)}
+		}
+	}
+
+	expiration, err := time.Parse(time.RFC3339, creds.Expiration)
+	if err != nil {
+		return nil, &InvalidCredentialsError{errors.Errorf("invalid Expiration \"%s\"", creds.Expiration)}
+	}
+
+	if !expiration.After(time.Now()) {
+		return nil, &InvalidCredentialsError{errors.Errorf("credentials expired at %s", creds.Expiration)}
+	}
+
+	normalized := *creds
+	normalized.Expiration = expiration.UTC().Format(time.RFC3339)
+	return &normalized, nil
+}
+
+// NewURLCredentialsProvider gets the credentials from the single backend credentialsUrl. It panics when the
+// backend pool can't be built.
+func NewURLCredentialsProvider(httpClient *http.Client, credentialsUrl string) *URLCredentialsProvider {
+	backends, err := NewBackendPool([]string{credentialsUrl}, FailoverStrategy)
+	if err != nil {
+		log.Panicf("Couldn't build the credentials backend pool of %s: %s", credentialsUrl, err)
+	}
+
+	return NewFailoverURLCredentialsProvider(httpClient, backends)
+}
+
+// NewFailoverURLCredentialsProvider gets the credentials from the backends of the pool, trying the next one
+// when a backend can't be reached.
+func NewFailoverURLCredentialsProvider(httpClient *http.Client, backends *BackendPool) *URLCredentialsProvider {
+	return &URLCredentialsProvider{
+		httpClient,
+		backends,
+	}
+}
+
+// URLCredentialsProvider gets the credentials from ${credentialsUrl}/credentials/<jobId>
+type URLCredentialsProvider struct {
+	netClient *http.Client
+	backends  *BackendPool
+}
+
+// GetCredentials returns the answer of the first backend reachable. Backends that can't be reached are
+// removed from the rotation until they pass a health check.
+func (p *URLCredentialsProvider) GetCredentials(jobId string) (*credentials.IAMRoleCredentials, error) {
+	var err error
+	for _, credentialsUrl := range p.backends.Candidates() {
+		var creds *credentials.IAMRoleCredentials
+		creds, err = p.getCredentialsFrom(credentialsUrl, jobId)
+		if _, unavailable := err.(*CredentialsUnavailableError); !unavailable {
+			return creds, err
+		}
+
+		p.backends.MarkDown(credentialsUrl, err)
+	}
+
+	return nil, err
+}
+
+func (p *URLCredentialsProvider) getCredentialsFrom(credentialsUrl, jobId string) (*credentials.IAMRoleCredentials, error) {
+	// The job id is a single path segment, it mustn't change the path nor the query of the request
+	if jobId == "." || jobId == ".." {
+		return nil, &CredentialsNotFoundError{jobId}
+	}
+
+	response, err := p.netClient.Get(fmt.Sprintf("%s/credentials/%s", credentialsUrl, url.PathEscape(jobId)))
+	if err != nil {
+		return nil, &CredentialsUnavailableError{err}
+	}
+	defer response.Body.Close()
+
+	buf, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, &CredentialsUnavailableError{err}
+	}
+
+	log.Debug(string(buf[:]))
+
+	switch {
+	case response.StatusCode == http.StatusNotFound:
+		return nil, &CredentialsNotFoundError{jobId}
+	case response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= http.StatusInternalServerError:
+		return nil, &CredentialsUnavailableError{errors.Errorf("unexpected status code %d", response.StatusCode)}
+	case response.StatusCode != http.StatusOK:
+		return nil, &InvalidCredentialsError{errors.Errorf("unexpected status code %d", response.StatusCode)}
+	}
+
+	var creds = credentials.IAMRoleCredentials{}
+	if err := json.Unmarshal(buf, &creds); err != nil {
+		return nil, &InvalidCredentialsError{errors.Errorf("malformed body: %s", err)}
+	}
+
+	return &creds, nil
+}
+
+// CheckBackend fails when every backend is out of the rotation. It only reads the state of the pool, left
+// to the health checks and the requests, so the readiness probes don't change which backend is used.
+func (p *URLCredentialsProvider) CheckBackend() error {
+	if len(p.backends.Healthy()) == 0 {
+		return errors.Errorf("No credentials backend available: %s removed from the rotation",
+			strings.Join(p.backends.URLs(), ", "))
+	}
+
+	return nil
+}
+
+// CheckBackends checks the health of every backend, adding them to or removing them from the rotation. It
+// fails when none of them can be reached or answers without a server error.
+func (p *URLCredentialsProvider) CheckBackends() error {
+	failures := []string{}
+	for _, credentialsUrl := range p.backends.URLs() {
+		if err := p.checkBackend(credentialsUrl); err != nil {
+			p.backends.MarkDown(credentialsUrl, err)
+			failures = append(failures, fmt.Sprintf("%s: %s", credentialsUrl, err))
+			continue
+		}
+
+		p.backends.MarkUp(credentialsUrl)
+	}
+
+	if len(failures) == len(p.backends.URLs()) {
+		return errors.Errorf("No credentials backend available: %s", strings.Join(failures, ", "))
+	}
+
+	return nil
+}
+
+// StartHealthChecks checks the backends every interval until stop is closed
+func (p *URLCredentialsProvider) StartHealthChecks(interval time.Duration, stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := p.CheckBackends(); err != nil {
+					log.Error(err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// checkBackend fails when the backend can't be reached or answers with a server error
+func (p *URLCredentialsProvider) checkBackend(credentialsUrl string) error {
+	response, err := p.netClient.Get(credentialsUrl)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	if response.StatusCode >= http.StatusInternalServerError {
+		return errors.Errorf("Credentials service returned status code %d", response.StatusCode)
+	}
+
+	return nil
+}
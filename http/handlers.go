@@ -5,75 +5,205 @@ import (
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/aws/amazon-ecs-agent/agent/credentials"
-	"github.com/docker/distribution/uuid"
 	"github.com/schibsted/mesos2iam/pkg"
-	"io/ioutil"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
 
-func NewSecurityRequestHandler(finder pkg.JobFinder, httpClient *http.Client, credentialsUrl string, idPrefix string) *SecurityRequestHandler {
+func NewSecurityRequestHandler(finder pkg.JobFinder, provider CredentialsProvider, validator pkg.JobIdValidator) *SecurityRequestHandler {
 	return &SecurityRequestHandler{
 		finder,
-		httpClient,
-		credentialsUrl,
-		idPrefix,
+		provider,
+		validator,
+		nil,
+		nil,
 	}
 }
 
 type SecurityRequestHandler struct {
-	JobFinder      pkg.JobFinder
-	netClient      *http.Client
-	credentialsUrl string
-	idPrefix       string
+	JobFinder   pkg.JobFinder
+	provider    CredentialsProvider
+	validator   pkg.JobIdValidator
+	cache       *CredentialsCache
+	roleMapping *pkg.RoleMapping
+}
+
+// EnableCache makes the handler serve credentials from an in-memory cache refreshed refreshBefore they expire.
+func (h *SecurityRequestHandler) EnableCache(refreshBefore, idleTimeout time.Duration) *CredentialsCache {
+	h.cache = NewCredentialsCache(h.fetchCredentials, refreshBefore, idleTimeout)
+	return h.cache
+}
+
+// EnableRoleMapping makes the handler refuse the credentials of roles the job isn't allowed to assume.
+func (h *SecurityRequestHandler) EnableRoleMapping(mapping *pkg.RoleMapping) {
+	h.roleMapping = mapping
 }
 
 func (h *SecurityRequestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	jobId, err := h.JobFinder.FindJobIdFromRequest(r)
+	creds, ok := h.credentialsForRequest(w, r)
+	if !ok {
+		return
+	}
 
+	buf, err := json.Marshal(creds)
 	if err != nil {
-		errorMessage := fmt.Sprintf("Error getting JobId from http request: %s", err)
-		w.WriteHeader(400)
-		writeErrorResponse(errorMessage, 400, w)
-		log.Error(errorMessage)
+		writeErrorResponse(fmt.Sprintf("Couldn't encode credentials: %s", err.Error()), http.StatusInternalServerError, w)
 		return
 	}
 
-	_, err = uuid.Parse(jobId)
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(buf)
+}
+
+// credentialsForRequest returns the credentials of the job doing the request, writing the error response
+// when they can't be found.
+func (h *SecurityRequestHandler) credentialsForRequest(w http.ResponseWriter, r *http.Request) (*credentials.IAMRoleCredentials, bool) {
+	code, mode := http.StatusOK, "unknown"
+	defer func() {
+		credentialsRequests.Inc(strconv.Itoa(code), mode)
+	}()
+
+	job, err := h.findJob(r)
+
 	if err != nil {
-		errorMessage := "Invalid JobId in http request: " + jobId
-		writeErrorResponse(errorMessage, 400, w)
-		log.Error(errorMessage)
-		return
+		code = http.StatusBadRequest
+		writeCodedErrorResponse("NoIdInRequest", fmt.Sprintf("Error getting JobId from http request: %s", err), code, w)
+		return nil, false
 	}
 
-	log.Debug("JobId found: " + jobId)
+	if job.Mode != "" {
+		mode = job.Mode
+	}
+
+	jobId := job.Id
+	err = h.validator.Validate(jobId)
+	if err != nil {
+		code = http.StatusBadRequest
+		writeCodedErrorResponse("InvalidIdInRequest", "Invalid JobId in http request: "+err.Error(), code, w)
+		return nil, false
+	}
 
-	response, err := h.netClient.Get(fmt.Sprintf("%s/credentials/%s", h.credentialsUrl, jobId))
+	log.Debug("JobId found: " + jobId)
 
+	creds, err := h.getCredentials(jobId)
 	if err != nil {
+		code = credentialsErrorStatusCode(err)
 		errorMessage := fmt.Sprintf("Couldn't get credentials from Smaug: %s", err.Error())
-		writeErrorResponse(errorMessage, 500, w)
-		log.Error(errorMessage)
-		return
+		writeCodedErrorResponse(credentialsErrorCode(err), errorMessage, code, w)
+		return nil, false
 	}
 
-	buf, _ := ioutil.ReadAll(response.Body)
+	if h.roleMapping != nil {
+		if err := h.roleMapping.Allow(job, creds.RoleArn); err != nil {
+			code = http.StatusForbidden
+			writeCodedErrorResponse("AccessDenied", fmt.Sprintf("Credentials refused by the role mapping: %s", err), code, w)
+			return nil, false
+		}
+	}
 
-	var creds = credentials.IAMRoleCredentials{}
-	json.Unmarshal(buf, &creds)
+	return creds, true
+}
 
-	log.Debug(string(buf[:]))
+// CheckBackend tells if the backend of the credentials provider is reachable, when the provider can check it
+func (h *SecurityRequestHandler) CheckBackend() error {
+	if checker, ok := h.provider.(BackendChecker); ok {
+		return checker.CheckBackend()
+	}
 
-	w.Header().Add("Content-Type", "application/json")
-	w.Write(buf)
+	return nil
 }
 
+// findJob finds the job doing the request, with its framework and image when the job finder knows them
+func (h *SecurityRequestHandler) findJob(r *http.Request) (*pkg.Job, error) {
+	if finder, ok := h.JobFinder.(pkg.JobInfoFinder); ok {
+		return finder.FindJobFromRequest(r)
+	}
+
+	jobId, err := h.JobFinder.FindJobIdFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pkg.Job{Id: jobId}, nil
+}
+
+func (h *SecurityRequestHandler) getCredentials(jobId string) (*credentials.IAMRoleCredentials, error) {
+	if h.cache != nil {
+		return h.cache.Get(jobId)
+	}
+
+	return h.fetchCredentials(jobId)
+}
+
+// fetchCredentials gets the credentials of a job from the backend, refusing incomplete or expired ones
+func (h *SecurityRequestHandler) fetchCredentials(jobId string) (*credentials.IAMRoleCredentials, error) {
+	start := time.Now()
+	creds, err := h.provider.GetCredentials(jobId)
+	if err == nil {
+		creds, err = normalizeCredentials(creds)
+	}
+	if err != nil {
+		backendFetchDuration.ObserveSince(start, "error")
+		return nil, err
+	}
+	backendFetchDuration.ObserveSince(start, "ok")
+
+	// The series of a job is deleted when it leaves the cache, without cache nothing would ever delete it
+	if expiration, err := time.Parse(time.RFC3339, creds.Expiration); err == nil && h.cache != nil {
+		credentialsExpiration.Set(float64(expiration.Unix()), jobId)
+	}
+
+	return creds, nil
+}
+
+func credentialsErrorStatusCode(err error) int {
+	switch err.(type) {
+	case *CredentialsNotFoundError:
+		return http.StatusNotFound
+	case *CredentialsUnavailableError:
+		return http.StatusServiceUnavailable
+	case *InvalidCredentialsError:
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// credentialsErrorCode returns the code of the error body, using the codes of the ECS agent when it has one
+func credentialsErrorCode(err error) string {
+	switch err.(type) {
+	case *CredentialsNotFoundError:
+		return "NoCredentialsAssociated"
+	case *CredentialsUnavailableError:
+		return "CredentialsUnavailable"
+	case *InvalidCredentialsError:
+		return "InvalidCredentials"
+	default:
+		return "InternalServerError"
+	}
+}
+
+// errorResponse is the body of the error responses, in the shape of the errors of the ECS agent
+type errorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeErrorResponse writes an error with the status text as code, e.g. NotFound
 func writeErrorResponse(errorMessage string, returnCode int, writer http.ResponseWriter) {
+	writeCodedErrorResponse(strings.Replace(http.StatusText(returnCode), " ", "", -1), errorMessage, returnCode, writer)
+}
+
+func writeCodedErrorResponse(code, errorMessage string, returnCode int, writer http.ResponseWriter) {
 	log.Error(errorMessage)
+
+	buf, _ := json.Marshal(errorResponse{code, errorMessage})
+	writer.Header().Set("Content-Type", "application/json")
 	writer.WriteHeader(returnCode)
-	writer.Write([]byte(errorMessage))
+	writer.Write(buf)
 }
 
 func LogHandler(handler http.Handler) http.Handler {
@@ -113,12 +243,12 @@ func (t *logResponseWriter) WriteHeader(s int) {
 	t.Status = s
 }
 
+// remoteIP returns the IPv4 or IPv6 address of a host:port or [host]:port remote address
 func remoteIP(addr string) string {
-	index := strings.Index(addr, ":")
-
-	if index < 0 {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
 		return addr
 	}
 
-	return addr[:index]
+	return host
 }
@@ -5,16 +5,22 @@ import (
 	"github.com/aws/amazon-ecs-agent/agent/credentials"
 	"github.com/go-errors/errors"
 	http_pkg "github.com/schibsted/mesos2iam/http"
+	"github.com/schibsted/mesos2iam/metrics"
+	"github.com/schibsted/mesos2iam/pkg"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strings"
 	"testing"
 	"time"
 )
 
+// testExpiration is the expiration of the credentials returned by the mocked backends, in an hour
+var testExpiration = time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+
 func TestSecurityRequestHandler(t *testing.T) {
 	jobId := "4ea13548-caa8-48dc-af69-58a651d9fa3b"
 	req, err := http.NewRequest("GET", "/v2/credentials", nil)
@@ -27,7 +33,7 @@ func TestSecurityRequestHandler(t *testing.T) {
 
 	netClient := getMockNetClient("/credentials/" + jobId)
 
-	securityRequestHandler := http_pkg.NewSecurityRequestHandler(mockedJobFinder, netClient, "http://fakeSmaugUrl", "TARDIS_SCHID")
+	securityRequestHandler := http_pkg.NewSecurityRequestHandler(mockedJobFinder, http_pkg.NewURLCredentialsProvider(netClient, "http://fakeSmaugUrl"), pkg.NewUUIDv4JobIdValidator())
 	writer := httptest.NewRecorder()
 
 	securityRequestHandler.ServeHTTP(writer, req)
@@ -35,7 +41,7 @@ func TestSecurityRequestHandler(t *testing.T) {
 	writer.Flush()
 	body, _ := ioutil.ReadAll(writer.Body)
 	assert.Equal(t, 200, writer.Code)
-	assert.Equal(t, "{\"RoleArn\":\"roleArn\",\"AccessKeyId\":\"AccessKey\",\"SecretAccessKey\":\"Secret\",\"Token\":\"Token\",\"Expiration\":\"Expiration Date\"}", string(body))
+	assert.Equal(t, "{\"RoleArn\":\"roleArn\",\"AccessKeyId\":\"AccessKey\",\"SecretAccessKey\":\"Secret\",\"Token\":\"Token\",\"Expiration\":\""+testExpiration+"\"}", string(body))
 }
 
 func TestSecurityRequestHandlerInvalidJobId(t *testing.T) {
@@ -48,7 +54,7 @@ func TestSecurityRequestHandlerInvalidJobId(t *testing.T) {
 	mockedJobFinder.On("FindJobIdFromRequest", req).Return("invalidJobid", nil)
 
 	netClient := getMockNetClient("/credentials/")
-	securityRequestHandler := http_pkg.NewSecurityRequestHandler(mockedJobFinder, netClient, "http://fakeSmaugUrl", "TARDIS_SCHID")
+	securityRequestHandler := http_pkg.NewSecurityRequestHandler(mockedJobFinder, http_pkg.NewURLCredentialsProvider(netClient, "http://fakeSmaugUrl"), pkg.NewUUIDv4JobIdValidator())
 	writer := httptest.NewRecorder()
 
 	securityRequestHandler.ServeHTTP(writer, req)
@@ -56,7 +62,235 @@ func TestSecurityRequestHandlerInvalidJobId(t *testing.T) {
 	writer.Flush()
 	body, _ := ioutil.ReadAll(writer.Body)
 	assert.Equal(t, 400, writer.Code)
-	assert.Equal(t, "Invalid JobId in http request: invalidJobid", string(body))
+	assert.Equal(t, "application/json", writer.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"code":"InvalidIdInRequest","message":"Invalid JobId in http request: \"invalidJobid\" is not a valid uuidv4"}`, string(body))
+}
+
+func TestSecurityRequestHandlerWithCustomJobIdFormat(t *testing.T) {
+	jobId := "my-job"
+	req, err := http.NewRequest("GET", "/v2/credentials", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockedJobFinder := &MockedJobFinder{}
+	mockedJobFinder.On("FindJobIdFromRequest", req).Return(jobId, nil)
+
+	validator, _ := pkg.NewRegexpJobIdValidator("[a-z-]+")
+	netClient := getMockNetClient("/credentials/" + jobId)
+	securityRequestHandler := http_pkg.NewSecurityRequestHandler(mockedJobFinder, http_pkg.NewURLCredentialsProvider(netClient, "http://fakeSmaugUrl"), validator)
+	writer := httptest.NewRecorder()
+
+	securityRequestHandler.ServeHTTP(writer, req)
+
+	assert.Equal(t, 200, writer.Code)
+}
+
+func TestSecurityRequestHandlerRefusesRolesNotInTheRoleMapping(t *testing.T) {
+	jobId := "4ea13548-caa8-48dc-af69-58a651d9fa3b"
+	req, err := http.NewRequest("GET", "/v2/credentials", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := ioutil.TempFile("", "roles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`{"rules": [{"jobs": ["` + jobId + `"], "roles": ["otherRoleArn"]}]}`)
+	file.Close()
+
+	mapping, err := pkg.NewRoleMappingFromFile(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockedJobFinder := &MockedJobFinder{}
+	mockedJobFinder.On("FindJobIdFromRequest", req).Return(jobId, nil)
+
+	netClient := getMockNetClient("/credentials/" + jobId)
+	securityRequestHandler := http_pkg.NewSecurityRequestHandler(mockedJobFinder, http_pkg.NewURLCredentialsProvider(netClient, "http://fakeSmaugUrl"), pkg.NewUUIDv4JobIdValidator())
+	securityRequestHandler.EnableRoleMapping(mapping)
+	writer := httptest.NewRecorder()
+
+	securityRequestHandler.ServeHTTP(writer, req)
+
+	body, _ := ioutil.ReadAll(writer.Body)
+	assert.Equal(t, 403, writer.Code)
+	assert.JSONEq(t, `{"code":"AccessDenied","message":"Credentials refused by the role mapping: Job `+jobId+` is not allowed to assume role roleArn"}`, string(body))
+}
+
+func TestSecurityRequestHandlerCountsRequests(t *testing.T) {
+	jobId := "4ea13548-caa8-48dc-af69-58a651d9fa3b"
+	req, err := http.NewRequest("GET", "/v2/credentials", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockedJobFinder := &MockedJobFinder{}
+	mockedJobFinder.On("FindJobIdFromRequest", req).Return(jobId, nil)
+
+	mockedProvider := &MockedCredentialsProvider{}
+	mockedProvider.On("GetCredentials", jobId).Return(nil, &http_pkg.CredentialsNotFoundError{JobId: jobId})
+
+	securityRequestHandler := http_pkg.NewSecurityRequestHandler(mockedJobFinder, mockedProvider, pkg.NewUUIDv4JobIdValidator())
+	securityRequestHandler.ServeHTTP(httptest.NewRecorder(), req)
+
+	writer := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(writer, req)
+
+	assert.Contains(t, writer.Body.String(), `mesos2iam_credentials_requests_total{code="404",mode="unknown"}`)
+	assert.Contains(t, writer.Body.String(), `mesos2iam_backend_fetch_duration_seconds_count{result="error"}`)
+}
+
+func TestSecurityRequestHandlerOnlyExportsExpirationsOfCachedCredentials(t *testing.T) {
+	uncachedJobId := "0f6ee3c4-64c8-4a4c-9a0c-5b1e4a8f7a01"
+	cachedJobId := "0f6ee3c4-64c8-4a4c-9a0c-5b1e4a8f7a02"
+	creds := &credentials.IAMRoleCredentials{
+		RoleArn:         "roleArn",
+		AccessKeyID:     "AccessKey",
+		SecretAccessKey: "Secret",
+		SessionToken:    "Token",
+		Expiration:      testExpiration,
+	}
+
+	for _, jobId := range []string{uncachedJobId, cachedJobId} {
+		req, _ := http.NewRequest("GET", "/v2/credentials", nil)
+		mockedJobFinder := &MockedJobFinder{}
+		mockedJobFinder.On("FindJobIdFromRequest", req).Return(jobId, nil)
+		mockedProvider := &MockedCredentialsProvider{}
+		mockedProvider.On("GetCredentials", jobId).Return(creds, nil)
+
+		securityRequestHandler := http_pkg.NewSecurityRequestHandler(mockedJobFinder, mockedProvider, pkg.NewUUIDv4JobIdValidator())
+		if jobId == cachedJobId {
+			securityRequestHandler.EnableCache(time.Minute, time.Hour)
+		}
+		securityRequestHandler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	writer := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(writer, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.NotContains(t, writer.Body.String(), `mesos2iam_credentials_expiration_timestamp_seconds{job_id="`+uncachedJobId+`"}`)
+	assert.Contains(t, writer.Body.String(), `mesos2iam_credentials_expiration_timestamp_seconds{job_id="`+cachedJobId+`"}`)
+}
+
+func TestSecurityRequestHandlerCredentialsNotFound(t *testing.T) {
+	jobId := "4ea13548-caa8-48dc-af69-58a651d9fa3b"
+	req, err := http.NewRequest("GET", "/v2/credentials", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockedJobFinder := &MockedJobFinder{}
+	mockedJobFinder.On("FindJobIdFromRequest", req).Return(jobId, nil)
+
+	mockedProvider := &MockedCredentialsProvider{}
+	mockedProvider.On("GetCredentials", jobId).Return(nil, &http_pkg.CredentialsNotFoundError{JobId: jobId})
+
+	securityRequestHandler := http_pkg.NewSecurityRequestHandler(mockedJobFinder, mockedProvider, pkg.NewUUIDv4JobIdValidator())
+	writer := httptest.NewRecorder()
+
+	securityRequestHandler.ServeHTTP(writer, req)
+
+	assert.Equal(t, 404, writer.Code)
+	mockedProvider.AssertExpectations(t)
+}
+
+func TestSecurityRequestHandlerCredentialsUnavailable(t *testing.T) {
+	jobId := "4ea13548-caa8-48dc-af69-58a651d9fa3b"
+	req, err := http.NewRequest("GET", "/v2/credentials", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockedJobFinder := &MockedJobFinder{}
+	mockedJobFinder.On("FindJobIdFromRequest", req).Return(jobId, nil)
+
+	mockedProvider := &MockedCredentialsProvider{}
+	mockedProvider.On("GetCredentials", jobId).Return(nil, &http_pkg.CredentialsUnavailableError{Err: errors.New("timeout")})
+
+	securityRequestHandler := http_pkg.NewSecurityRequestHandler(mockedJobFinder, mockedProvider, pkg.NewUUIDv4JobIdValidator())
+	writer := httptest.NewRecorder()
+
+	securityRequestHandler.ServeHTTP(writer, req)
+
+	assert.Equal(t, 503, writer.Code)
+	mockedProvider.AssertExpectations(t)
+}
+
+func TestSecurityRequestHandlerRejectsInvalidBackendResponses(t *testing.T) {
+	jobId := "4ea13548-caa8-48dc-af69-58a651d9fa3b"
+	expired := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+
+	for _, test := range []struct {
+		status       int
+		body         string
+		expectedCode int
+		expectedBody string
+	}{
+		{200, "<html>Bad gateway</html>", 502, "InvalidCredentials"},
+		{200, `{"RoleArn":"roleArn","AccessKeyId":"AccessKey","SecretAccessKey":"Secret","Token":"Token","Expiration":"` + expired + `"}`, 502, "InvalidCredentials"},
+		{200, `{"RoleArn":"roleArn","AccessKeyId":"AccessKey","Expiration":"` + testExpiration + `"}`, 502, "InvalidCredentials"},
+		{403, `{"message":"forbidden"}`, 502, "InvalidCredentials"},
+		{429, "", 503, "CredentialsUnavailable"},
+		{404, "", 404, "NoCredentialsAssociated"},
+	} {
+		req, _ := http.NewRequest("GET", "/v2/credentials", nil)
+		mockedJobFinder := &MockedJobFinder{}
+		mockedJobFinder.On("FindJobIdFromRequest", req).Return(jobId, nil)
+
+		status, body := test.status, test.body
+		netClient := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: status, Body: ioutil.NopCloser(strings.NewReader(body)), Request: r}, nil
+		})}
+		securityRequestHandler := http_pkg.NewSecurityRequestHandler(mockedJobFinder, http_pkg.NewURLCredentialsProvider(netClient, "http://fakeSmaugUrl"), pkg.NewUUIDv4JobIdValidator())
+		writer := httptest.NewRecorder()
+
+		securityRequestHandler.ServeHTTP(writer, req)
+
+		var response map[string]string
+		assert.Equal(t, test.expectedCode, writer.Code, test.body)
+		assert.NoError(t, json.Unmarshal(writer.Body.Bytes(), &response))
+		assert.Equal(t, test.expectedBody, response["code"], test.body)
+	}
+}
+
+func TestURLCredentialsProviderEscapesTheJobId(t *testing.T) {
+	requested := []string{}
+	netClient := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		requested = append(requested, r.URL.String())
+		return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+	})}
+	provider := http_pkg.NewURLCredentialsProvider(netClient, "http://fakeSmaugUrl")
+
+	for _, jobId := range []string{"../admin", "job?role=admin", "job#fragment", "..", "."} {
+		_, err := provider.GetCredentials(jobId)
+		assert.IsType(t, &http_pkg.CredentialsNotFoundError{}, err, jobId)
+	}
+
+	assert.Equal(t, []string{
+		"http://fakeSmaugUrl/credentials/..%2Fadmin",
+		"http://fakeSmaugUrl/credentials/job%3Frole=admin",
+		"http://fakeSmaugUrl/credentials/job%23fragment",
+	}, requested)
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+type MockedCredentialsProvider struct {
+	mock.Mock
+}
+
+func (m *MockedCredentialsProvider) GetCredentials(jobId string) (*credentials.IAMRoleCredentials, error) {
+	args := m.Called(jobId)
+	creds, _ := args.Get(0).(*credentials.IAMRoleCredentials)
+	return creds, args.Error(1)
 }
 
 type MockedJobFinder struct {
@@ -88,7 +322,7 @@ func newMockTransport(requestUrl string) http.RoundTripper {
 		"AccessKey",
 		"Secret",
 		"Token",
-		"Expiration Date",
+		testExpiration,
 	}
 	return &mockTransport{
 		creds,
@@ -0,0 +1,115 @@
+package http
+
+import (
+	"encoding/json"
+	"github.com/go-errors/errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Time a readiness check can take before it's considered failed
+const healthCheckTimeout = time.Second * 5
+
+// HealthCheck is a dependency of mesos2iam checked by /readyz
+type HealthCheck struct {
+	Name  string
+	Check func() error
+}
+
+type healthCheckStatus struct {
+	Name          string `json:"name"`
+	Status        string `json:"status"`
+	LastError     string `json:"lastError,omitempty"`
+	LastErrorTime string `json:"lastErrorTime,omitempty"`
+}
+
+type healthStatus struct {
+	Status string              `json:"status"`
+	Checks []healthCheckStatus `json:"checks,omitempty"`
+}
+
+// HealthHandler answers while the process is alive
+func HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeHealthStatus(w, http.StatusOK, healthStatus{Status: "ok"})
+	})
+}
+
+func NewReadinessHandler(checks ...HealthCheck) *ReadinessHandler {
+	return &ReadinessHandler{
+		checks:     checks,
+		lastErrors: map[string]healthCheckStatus{},
+	}
+}
+
+// ReadinessHandler runs all its checks on every request, answering 503 when any of them fails. The last
+// error of every check is kept so it's reported even once the check succeeds again.
+type ReadinessHandler struct {
+	checks []HealthCheck
+
+	mutex      sync.Mutex
+	lastErrors map[string]healthCheckStatus
+}
+
+func (h *ReadinessHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	results := make([]error, len(h.checks))
+	wg := sync.WaitGroup{}
+	for i, check := range h.checks {
+		wg.Add(1)
+		go func(i int, check HealthCheck) {
+			defer wg.Done()
+			results[i] = runHealthCheck(check)
+		}(i, check)
+	}
+	wg.Wait()
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	status := healthStatus{Status: "ok", Checks: []healthCheckStatus{}}
+	for i, check := range h.checks {
+		checkStatus := h.lastErrors[check.Name]
+		checkStatus.Name = check.Name
+		checkStatus.Status = "ok"
+
+		if err := results[i]; err != nil {
+			checkStatus.Status = "failing"
+			checkStatus.LastError = err.Error()
+			checkStatus.LastErrorTime = time.Now().UTC().Format(time.RFC3339)
+			h.lastErrors[check.Name] = checkStatus
+			status.Status = "failing"
+		}
+
+		status.Checks = append(status.Checks, checkStatus)
+	}
+
+	code := http.StatusOK
+	if status.Status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+
+	writeHealthStatus(w, code, status)
+}
+
+func runHealthCheck(check HealthCheck) error {
+	result := make(chan error, 1)
+	go func() {
+		result <- check.Check()
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(healthCheckTimeout):
+		return errors.Errorf("Timed out after %s", healthCheckTimeout)
+	}
+}
+
+func writeHealthStatus(w http.ResponseWriter, code int, status healthStatus) {
+	buf, _ := json.Marshal(status)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(buf)
+}
@@ -0,0 +1,97 @@
+package http_test
+
+import (
+	"encoding/json"
+	"github.com/go-errors/errors"
+	http_pkg "github.com/schibsted/mesos2iam/http"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type readinessResponse struct {
+	Status string `json:"status"`
+	Checks []struct {
+		Name      string `json:"name"`
+		Status    string `json:"status"`
+		LastError string `json:"lastError"`
+	} `json:"checks"`
+}
+
+func getReadiness(t *testing.T, handler http.Handler) (int, readinessResponse) {
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, httptest.NewRequest("GET", "/readyz", nil))
+
+	response := readinessResponse{}
+	if err := json.Unmarshal(writer.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	return writer.Code, response
+}
+
+func TestHealthHandler(t *testing.T) {
+	writer := httptest.NewRecorder()
+	http_pkg.HealthHandler().ServeHTTP(writer, httptest.NewRequest("GET", "/healthz", nil))
+
+	assert.Equal(t, 200, writer.Code)
+	assert.Equal(t, `{"status":"ok"}`, writer.Body.String())
+}
+
+func TestReadinessHandlerReportsTheLastErrorOfEveryCheck(t *testing.T) {
+	var dockerErr error = errors.New("Cannot connect to the Docker daemon")
+	handler := http_pkg.NewReadinessHandler(
+		http_pkg.HealthCheck{Name: "docker", Check: func() error { return dockerErr }},
+		http_pkg.HealthCheck{Name: "credentials-backend", Check: func() error { return nil }},
+	)
+
+	code, response := getReadiness(t, handler)
+	assert.Equal(t, 503, code)
+	assert.Equal(t, "failing", response.Status)
+	assert.Equal(t, "docker", response.Checks[0].Name)
+	assert.Equal(t, "failing", response.Checks[0].Status)
+	assert.Equal(t, "Cannot connect to the Docker daemon", response.Checks[0].LastError)
+	assert.Equal(t, "ok", response.Checks[1].Status)
+	assert.Empty(t, response.Checks[1].LastError)
+
+	dockerErr = nil
+	code, response = getReadiness(t, handler)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "ok", response.Status)
+	assert.Equal(t, "ok", response.Checks[0].Status)
+	assert.Equal(t, "Cannot connect to the Docker daemon", response.Checks[0].LastError)
+}
+
+func TestURLCredentialsProviderCheckBackends(t *testing.T) {
+	status := 200
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer backend.Close()
+
+	provider := http_pkg.NewURLCredentialsProvider(&http.Client{}, backend.URL)
+	assert.NoError(t, provider.CheckBackends())
+
+	status = 503
+	assert.Error(t, provider.CheckBackends())
+
+	backend.Close()
+	assert.Error(t, provider.CheckBackends())
+}
+
+func TestURLCredentialsProviderCheckBackendOnlyReadsThePool(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(503)
+	}))
+	defer backend.Close()
+
+	pool, _ := http_pkg.NewBackendPool([]string{backend.URL}, http_pkg.FailoverStrategy)
+	provider := http_pkg.NewFailoverURLCredentialsProvider(&http.Client{}, pool)
+
+	assert.NoError(t, provider.CheckBackend())
+	assert.Equal(t, []string{backend.URL}, pool.Healthy(), "the readiness check doesn't remove the backend")
+
+	assert.Error(t, provider.CheckBackends())
+	assert.Error(t, provider.CheckBackend())
+}
@@ -0,0 +1,168 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/amazon-ecs-agent/agent/credentials"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// SecurityCredentialsPath is the EC2 instance metadata path listing the role of the instance profile.
+const SecurityCredentialsPath = "/latest/meta-data/iam/security-credentials/"
+
+// proxiedMetadataPaths are the metadata paths harmless to share with the containers, proxied to the real
+// metadata service. Paths ending with a slash include everything below them. The other paths, e.g. the
+// credentials of the instance in identity-credentials/, iam/info, user-data or the signed identity document,
+// are not found.
+var proxiedMetadataPaths = []string{
+	"/latest/meta-data/ami-id",
+	"/latest/meta-data/hostname",
+	"/latest/meta-data/instance-id",
+	"/latest/meta-data/instance-type",
+	"/latest/meta-data/local-hostname",
+	"/latest/meta-data/local-ipv4",
+	"/latest/meta-data/mac",
+	"/latest/meta-data/placement/",
+	"/latest/dynamic/instance-identity/document",
+}
+
+// ec2RoleCredentials is the shape of the credentials returned by the EC2 instance metadata service
+type ec2RoleCredentials struct {
+	Code            string
+	LastUpdated     string
+	Type            string
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+	Expiration      string
+}
+
+// NewMetadataRequestHandler creates the EC2 metadata emulation. When requireToken is set, every request must
+// carry an IMDSv2 session token; otherwise IMDSv1 requests without token are served too.
+func NewMetadataRequestHandler(credentialsHandler *SecurityRequestHandler, metadataUrl *url.URL, tokens *MetadataTokenStore, requireToken bool) *MetadataRequestHandler {
+	return &MetadataRequestHandler{
+		credentialsHandler,
+		newMetadataProxy(metadataUrl),
+		tokens,
+		requireToken,
+	}
+}
+
+// MetadataRequestHandler emulates the IAM endpoints of the EC2 instance metadata service, serving the
+// credentials of the job doing the request as if they were the ones of the instance profile. Requests to the
+// proxiedMetadataPaths are proxied to the real metadata service.
+type MetadataRequestHandler struct {
+	credentialsHandler *SecurityRequestHandler
+	metadataProxy      http.Handler
+	tokens             *MetadataTokenStore
+	requireToken       bool
+}
+
+func (h *MetadataRequestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == TokenPath {
+		h.serveToken(w, r)
+		return
+	}
+
+	if !h.authorized(r) {
+		writeErrorResponse("Missing or invalid "+TokenHeader, http.StatusUnauthorized, w)
+		return
+	}
+
+	if !strings.HasPrefix(r.URL.Path+"/", SecurityCredentialsPath) {
+		if !proxiedMetadataPath(r.URL.Path) {
+			writeErrorResponse(fmt.Sprintf("Metadata %s not available to containers", r.URL.Path), http.StatusNotFound, w)
+			return
+		}
+
+		h.metadataProxy.ServeHTTP(w, r)
+		return
+	}
+
+	creds, ok := h.credentialsHandler.credentialsForRequest(w, r)
+	if !ok {
+		return
+	}
+
+	roleName := roleNameFromArn(creds.RoleArn)
+	requestedRole := strings.Trim(strings.TrimPrefix(r.URL.Path+"/", SecurityCredentialsPath), "/")
+
+	if requestedRole == "" {
+		w.Header().Add("Content-Type", "text/plain")
+		w.Write([]byte(roleName))
+		return
+	}
+
+	if requestedRole != roleName {
+		writeErrorResponse(fmt.Sprintf("Role %s not found", requestedRole), http.StatusNotFound, w)
+		return
+	}
+
+	buf, err := json.Marshal(toEC2RoleCredentials(creds))
+	if err != nil {
+		writeErrorResponse(fmt.Sprintf("Couldn't encode credentials: %s", err.Error()), 500, w)
+		return
+	}
+
+	log.Debugf("Serving credentials of role %s through the EC2 metadata endpoint", roleName)
+
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(buf)
+}
+
+// newMetadataProxy forwards requests to the real metadata service, replacing the session token issued by
+// mesos2iam with one of the real service.
+func newMetadataProxy(metadataUrl *url.URL) http.Handler {
+	upstreamTokens := newUpstreamTokenSource(metadataUrl.String())
+	proxy := httputil.NewSingleHostReverseProxy(metadataUrl)
+
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		r.Header.Del(TokenHeader)
+		if token := upstreamTokens.Token(); token != "" {
+			r.Header.Set(TokenHeader, token)
+		}
+	}
+
+	return proxy
+}
+
+// proxiedMetadataPath tells if the path is one of the proxiedMetadataPaths, refusing paths that aren't clean so
+// they can't be resolved to another path by the real metadata service
+func proxiedMetadataPath(requestPath string) bool {
+	if cleaned := path.Clean(requestPath); requestPath != cleaned && requestPath != cleaned+"/" {
+		return false
+	}
+
+	for _, proxied := range proxiedMetadataPaths {
+		if requestPath == proxied || strings.HasSuffix(proxied, "/") && strings.HasPrefix(requestPath+"/", proxied) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func toEC2RoleCredentials(creds *credentials.IAMRoleCredentials) *ec2RoleCredentials {
+	return &ec2RoleCredentials{
+		Code:            "Success",
+		LastUpdated:     time.Now().UTC().Format(time.RFC3339),
+		Type:            "AWS-HMAC",
+		AccessKeyId:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		Token:           creds.SessionToken,
+		Expiration:      creds.Expiration,
+	}
+}
+
+// roleNameFromArn returns the last part of a role ARN such as arn:aws:iam::123456789012:role/path/name
+func roleNameFromArn(roleArn string) string {
+	return roleArn[strings.LastIndex(roleArn, "/")+1:]
+}
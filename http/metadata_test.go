@@ -0,0 +1,221 @@
+package http_test
+
+import (
+	"encoding/json"
+	"github.com/aws/amazon-ecs-agent/agent/credentials"
+	http_pkg "github.com/schibsted/mesos2iam/http"
+	"github.com/schibsted/mesos2iam/pkg"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+const metadataTestJobId = "4ea13548-caa8-48dc-af69-58a651d9fa3b"
+
+func newMetadataTestHandler(t *testing.T, req *http.Request, upstream *httptest.Server) *http_pkg.MetadataRequestHandler {
+	return newMetadataTestHandlerWithTokens(t, req, upstream, http_pkg.NewMetadataTokenStore(), false)
+}
+
+func newMetadataTestHandlerWithTokens(t *testing.T, req *http.Request, upstream *httptest.Server, tokens *http_pkg.MetadataTokenStore, requireToken bool) *http_pkg.MetadataRequestHandler {
+	mockedJobFinder := &MockedJobFinder{}
+	mockedJobFinder.On("FindJobIdFromRequest", req).Return(metadataTestJobId, nil)
+
+	mockedProvider := &MockedCredentialsProvider{}
+	mockedProvider.On("GetCredentials", metadataTestJobId).Return(&credentials.IAMRoleCredentials{
+		RoleArn:         "arn:aws:iam::123456789012:role/path/my-role",
+		AccessKeyID:     "AccessKey",
+		SecretAccessKey: "Secret",
+		SessionToken:    "Token",
+		Expiration:      testExpiration,
+	}, nil)
+
+	metadataUrl, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credentialsHandler := http_pkg.NewSecurityRequestHandler(mockedJobFinder, mockedProvider, pkg.NewUUIDv4JobIdValidator())
+	return http_pkg.NewMetadataRequestHandler(credentialsHandler, metadataUrl, tokens, requireToken)
+}
+
+func TestMetadataRequestHandlerListsRole(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	defer upstream.Close()
+
+	req := httptest.NewRequest("GET", "/latest/meta-data/iam/security-credentials/", nil)
+	writer := httptest.NewRecorder()
+
+	newMetadataTestHandler(t, req, upstream).ServeHTTP(writer, req)
+
+	assert.Equal(t, 200, writer.Code)
+	assert.Equal(t, "my-role", writer.Body.String())
+}
+
+func TestMetadataRequestHandlerReturnsRoleCredentials(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	defer upstream.Close()
+
+	req := httptest.NewRequest("GET", "/latest/meta-data/iam/security-credentials/my-role", nil)
+	writer := httptest.NewRecorder()
+
+	newMetadataTestHandler(t, req, upstream).ServeHTTP(writer, req)
+
+	var body map[string]string
+	assert.Equal(t, 200, writer.Code)
+	assert.NoError(t, json.Unmarshal(writer.Body.Bytes(), &body))
+	assert.Equal(t, "Success", body["Code"])
+	assert.Equal(t, "AWS-HMAC", body["Type"])
+	assert.Equal(t, "AccessKey", body["AccessKeyId"])
+	assert.Equal(t, "Secret", body["SecretAccessKey"])
+	assert.Equal(t, "Token", body["Token"])
+	assert.Equal(t, testExpiration, body["Expiration"])
+}
+
+func TestMetadataRequestHandlerRejectsOtherRoles(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	defer upstream.Close()
+
+	req := httptest.NewRequest("GET", "/latest/meta-data/iam/security-credentials/instance-role", nil)
+	writer := httptest.NewRecorder()
+
+	newMetadataTestHandler(t, req, upstream).ServeHTTP(writer, req)
+
+	assert.Equal(t, 404, writer.Code)
+}
+
+func TestMetadataRequestHandlerProxiesOtherPaths(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream " + r.URL.Path))
+	}))
+	defer upstream.Close()
+
+	req := httptest.NewRequest("GET", "/latest/meta-data/placement/availability-zone", nil)
+	writer := httptest.NewRecorder()
+
+	newMetadataTestHandler(t, req, upstream).ServeHTTP(writer, req)
+
+	assert.Equal(t, 200, writer.Code)
+	assert.Equal(t, "upstream /latest/meta-data/placement/availability-zone", writer.Body.String())
+}
+
+func TestMetadataRequestHandlerRefusesInstancePaths(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream " + r.URL.Path))
+	}))
+	defer upstream.Close()
+
+	for _, path := range []string{
+		"/latest/meta-data/identity-credentials/ec2/security-credentials/ec2-instance",
+		"/latest/meta-data/iam/info",
+		"/latest/user-data",
+		"/latest/dynamic/instance-identity/pkcs7",
+		"/latest/meta-data/placement/../iam/info",
+		"/latest/meta-data/",
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.URL.Path = path
+		writer := httptest.NewRecorder()
+
+		newMetadataTestHandler(t, req, upstream).ServeHTTP(writer, req)
+
+		assert.Equal(t, 404, writer.Code, path)
+		assert.NotContains(t, writer.Body.String(), "upstream", path)
+	}
+}
+
+func TestMetadataRequestHandlerIssuesSessionTokens(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	defer upstream.Close()
+
+	tokens := http_pkg.NewMetadataTokenStore()
+
+	tokenReq := httptest.NewRequest("PUT", "/latest/api/token", nil)
+	tokenReq.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	tokenWriter := httptest.NewRecorder()
+	newMetadataTestHandlerWithTokens(t, tokenReq, upstream, tokens, true).ServeHTTP(tokenWriter, tokenReq)
+
+	assert.Equal(t, 200, tokenWriter.Code)
+	assert.Equal(t, "21600", tokenWriter.Header().Get("X-aws-ec2-metadata-token-ttl-seconds"))
+
+	req := httptest.NewRequest("GET", "/latest/meta-data/iam/security-credentials/", nil)
+	req.Header.Set("X-aws-ec2-metadata-token", tokenWriter.Body.String())
+	writer := httptest.NewRecorder()
+	newMetadataTestHandlerWithTokens(t, req, upstream, tokens, true).ServeHTTP(writer, req)
+
+	assert.Equal(t, 200, writer.Code)
+	assert.Equal(t, "my-role", writer.Body.String())
+}
+
+func TestMetadataRequestHandlerRejectsInvalidTokenRequests(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	defer upstream.Close()
+
+	withoutTTL := httptest.NewRequest("PUT", "/latest/api/token", nil)
+	writer := httptest.NewRecorder()
+	newMetadataTestHandler(t, withoutTTL, upstream).ServeHTTP(writer, withoutTTL)
+	assert.Equal(t, 400, writer.Code)
+
+	forwarded := httptest.NewRequest("PUT", "/latest/api/token", nil)
+	forwarded.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	forwarded.Header.Set("X-Forwarded-For", "10.0.0.1")
+	writer = httptest.NewRecorder()
+	newMetadataTestHandler(t, forwarded, upstream).ServeHTTP(writer, forwarded)
+	assert.Equal(t, 403, writer.Code)
+}
+
+func TestMetadataRequestHandlerRejectsMissingAndForeignTokens(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	defer upstream.Close()
+
+	tokens := http_pkg.NewMetadataTokenStore()
+	token, err := tokens.Issue("172.17.0.3", time.Minute)
+	assert.NoError(t, err)
+
+	withoutToken := httptest.NewRequest("GET", "/latest/meta-data/iam/security-credentials/", nil)
+	writer := httptest.NewRecorder()
+	newMetadataTestHandlerWithTokens(t, withoutToken, upstream, tokens, true).ServeHTTP(writer, withoutToken)
+	assert.Equal(t, 401, writer.Code)
+
+	foreignToken := httptest.NewRequest("GET", "/latest/meta-data/iam/security-credentials/", nil)
+	foreignToken.RemoteAddr = "172.17.0.2:10000"
+	foreignToken.Header.Set("X-aws-ec2-metadata-token", token)
+	writer = httptest.NewRecorder()
+	newMetadataTestHandlerWithTokens(t, foreignToken, upstream, tokens, false).ServeHTTP(writer, foreignToken)
+	assert.Equal(t, 401, writer.Code)
+}
+
+func TestMetadataTokenStoreExpiresTokens(t *testing.T) {
+	tokens := http_pkg.NewMetadataTokenStore()
+
+	token, err := tokens.Issue("172.17.0.2", time.Millisecond)
+	assert.NoError(t, err)
+	time.Sleep(5 * time.Millisecond)
+
+	assert.False(t, tokens.Valid(token, "172.17.0.2"))
+}
+
+func TestMetadataTokenStoreRevokesTheOldestTokensOfAnIp(t *testing.T) {
+	tokens := http_pkg.NewMetadataTokenStore()
+
+	first, err := tokens.Issue("172.17.0.2", time.Hour)
+	assert.NoError(t, err)
+	other, err := tokens.Issue("172.17.0.3", time.Hour)
+	assert.NoError(t, err)
+
+	issued := []string{}
+	for i := 0; i < 32; i++ {
+		time.Sleep(time.Microsecond)
+		token, err := tokens.Issue("172.17.0.2", time.Hour)
+		assert.NoError(t, err)
+		issued = append(issued, token)
+	}
+
+	assert.False(t, tokens.Valid(first, "172.17.0.2"))
+	for _, token := range issued {
+		assert.True(t, tokens.Valid(token, "172.17.0.2"))
+	}
+	assert.True(t, tokens.Valid(other, "172.17.0.3"))
+}
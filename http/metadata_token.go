@@ -0,0 +1,197 @@
+package http
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-errors/errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// TokenPath is the IMDSv2 path issuing session tokens
+	TokenPath = "/latest/api/token"
+	// TokenHeader carries the session token in every IMDSv2 request
+	TokenHeader = "X-aws-ec2-metadata-token"
+	// TokenTTLHeader carries the lifetime in seconds of the requested session token
+	TokenTTLHeader = "X-aws-ec2-metadata-token-ttl-seconds"
+
+	maxTokenTTL = 6 * time.Hour
+	// maxTokensPerIp bounds the tokens kept for every remote IP, issuing another one revokes the oldest
+	maxTokensPerIp = 32
+)
+
+type metadataToken struct {
+	remoteIp   string
+	issued     time.Time
+	expiration time.Time
+}
+
+func NewMetadataTokenStore() *MetadataTokenStore {
+	return &MetadataTokenStore{
+		tokens: make(map[string]*metadataToken),
+	}
+}
+
+// MetadataTokenStore issues and validates IMDSv2 session tokens. Every token can only be used from the IP
+// address that requested it.
+type MetadataTokenStore struct {
+	mutex  sync.Mutex
+	tokens map[string]*metadataToken
+}
+
+// Issue returns a new token for remoteIp valid for ttl. Once remoteIp has maxTokensPerIp valid tokens, its
+// oldest one is revoked.
+func (s *MetadataTokenStore) Issue(remoteIp string, ttl time.Duration) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	count, oldest := 0, ""
+	for t, issued := range s.tokens {
+		if !now.Before(issued.expiration) {
+			delete(s.tokens, t)
+			continue
+		}
+
+		if issued.remoteIp == remoteIp {
+			count++
+			if oldest == "" || issued.issued.Before(s.tokens[oldest].issued) {
+				oldest = t
+			}
+		}
+	}
+
+	if count >= maxTokensPerIp {
+		delete(s.tokens, oldest)
+	}
+
+	s.tokens[token] = &metadataToken{remoteIp, now, now.Add(ttl)}
+	return token, nil
+}
+
+// Valid tells whether token was issued to remoteIp and has not expired yet.
+func (s *MetadataTokenStore) Valid(token, remoteIp string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	issued, ok := s.tokens[token]
+	return ok && issued.remoteIp == remoteIp && time.Now().Before(issued.expiration)
+}
+
+// serveToken handles the PUT requests creating session tokens
+func (h *MetadataRequestHandler) serveToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		writeErrorResponse("Session tokens must be requested with PUT", http.StatusMethodNotAllowed, w)
+		return
+	}
+
+	// Like the EC2 metadata service, refuse requests that went through a proxy; they don't come from the
+	// container itself.
+	if r.Header.Get("X-Forwarded-For") != "" {
+		writeErrorResponse("Forwarded token requests are not allowed", http.StatusForbidden, w)
+		return
+	}
+
+	seconds, err := strconv.Atoi(r.Header.Get(TokenTTLHeader))
+	ttl := time.Duration(seconds) * time.Second
+	if err != nil || seconds <= 0 || ttl > maxTokenTTL {
+		writeErrorResponse("Invalid "+TokenTTLHeader, http.StatusBadRequest, w)
+		return
+	}
+
+	token, err := h.tokens.Issue(remoteIP(r.RemoteAddr), ttl)
+	if err != nil {
+		writeErrorResponse("Couldn't create session token: "+err.Error(), http.StatusInternalServerError, w)
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/plain")
+	w.Header().Add(TokenTTLHeader, strconv.Itoa(seconds))
+	w.Write([]byte(token))
+}
+
+// authorized checks the session token of the request, which is only optional when tokens aren't required.
+func (h *MetadataRequestHandler) authorized(r *http.Request) bool {
+	token := r.Header.Get(TokenHeader)
+	if token == "" {
+		return !h.requireToken
+	}
+
+	return h.tokens.Valid(token, remoteIP(r.RemoteAddr))
+}
+
+func newUpstreamTokenSource(metadataUrl string) *upstreamTokenSource {
+	return &upstreamTokenSource{
+		netClient: &http.Client{
+			Timeout: time.Second * 2,
+		},
+		tokenUrl: metadataUrl + TokenPath,
+	}
+}
+
+// upstreamTokenSource keeps a session token of the real metadata service to proxy the requests that aren't
+// emulated by mesos2iam.
+type upstreamTokenSource struct {
+	netClient  *http.Client
+	tokenUrl   string
+	mutex      sync.Mutex
+	token      string
+	expiration time.Time
+}
+
+// Token returns a valid session token of the real metadata service, or an empty string if it can't be
+// obtained; in that case the request is proxied as an IMDSv1 one.
+func (s *upstreamTokenSource) Token() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.token != "" && time.Now().Add(time.Minute).Before(s.expiration) {
+		return s.token
+	}
+
+	token, err := s.requestToken()
+	if err != nil {
+		log.Warn("Couldn't get a session token from the EC2 metadata service: ", err)
+		return ""
+	}
+
+	s.token = token
+	s.expiration = time.Now().Add(maxTokenTTL)
+	return s.token
+}
+
+func (s *upstreamTokenSource) requestToken() (string, error) {
+	request, err := http.NewRequest(http.MethodPut, s.tokenUrl, nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set(TokenTTLHeader, strconv.Itoa(int(maxTokenTTL.Seconds())))
+
+	response, err := s.netClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	buf, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return "", errors.Errorf("unexpected status code %d", response.StatusCode)
+	}
+
+	return string(buf), nil
+}
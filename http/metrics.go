@@ -0,0 +1,22 @@
+package http
+
+import "github.com/schibsted/mesos2iam/metrics"
+
+var (
+	credentialsRequests = metrics.NewCounterVec("mesos2iam_credentials_requests_total",
+		"Credentials requests, by response status code and resolution mode (host or bridge)", "code", "mode")
+	backendFetchDuration = metrics.NewHistogramVec("mesos2iam_backend_fetch_duration_seconds",
+		"Time to get the credentials of a job from the backend, by result", "result")
+	cacheRequests = metrics.NewCounterVec("mesos2iam_credentials_cache_requests_total",
+		"Lookups of credentials in the cache, by result (hit or miss)", "result")
+	credentialsExpiration = metrics.NewGaugeVec("mesos2iam_credentials_expiration_timestamp_seconds",
+		"Expiration of the last credentials obtained for every job, in seconds since the epoch", "job_id")
+	backendUp = metrics.NewGaugeVec("mesos2iam_backend_up",
+		"1 while the credentials backend is in the rotation, 0 after failing a request or a health check", "url")
+	backendRetries = metrics.NewCounterVec("mesos2iam_backend_retries_total",
+		"Requests to the backend retried after a failure")
+	breakerRejections = metrics.NewCounterVec("mesos2iam_backend_circuit_breaker_rejections_total",
+		"Requests failed without calling the backend while the circuit breaker is open")
+	breakerOpen = metrics.NewGaugeVec("mesos2iam_backend_circuit_breaker_open",
+		"1 while the circuit breaker of the backend is open, 0 otherwise")
+)
@@ -0,0 +1,148 @@
+package http
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/amazon-ecs-agent/agent/credentials"
+	"github.com/go-errors/errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// NewRetryingCredentialsProvider retries the requests to provider failing with a *CredentialsUnavailableError
+// up to retries times, waiting an exponential backoff starting at backoff and capped at maxBackoff between
+// attempts. The breaker, unless nil, fails the requests fast while the backend is down.
+func NewRetryingCredentialsProvider(provider CredentialsProvider, retries int, backoff, maxBackoff time.Duration, breaker *CircuitBreaker) *RetryingCredentialsProvider {
+	return &RetryingCredentialsProvider{provider, retries, backoff, maxBackoff, breaker}
+}
+
+// RetryingCredentialsProvider only retries the failures of the backend retrying may fix: a job without
+// credentials or invalid credentials are returned right away.
+type RetryingCredentialsProvider struct {
+	provider   CredentialsProvider
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	breaker    *CircuitBreaker
+}
+
+func (p *RetryingCredentialsProvider) GetCredentials(jobId string) (*credentials.IAMRoleCredentials, error) {
+	for attempt := 0; ; attempt++ {
+		if p.breaker != nil && !p.breaker.Allow() {
+			breakerRejections.Inc()
+			return nil, &CredentialsUnavailableError{errors.New("circuit breaker open, backend considered down")}
+		}
+
+		creds, err := p.provider.GetCredentials(jobId)
+		if _, unavailable := err.(*CredentialsUnavailableError); !unavailable {
+			if p.breaker != nil {
+				p.breaker.Success()
+			}
+			return creds, err
+		}
+
+		if p.breaker != nil {
+			p.breaker.Failure()
+		}
+
+		if attempt >= p.retries {
+			return nil, err
+		}
+
+		delay := p.delay(attempt)
+		log.Warnf("Attempt %d to get credentials of JobId %s failed, retrying in %s: %s", attempt+1, jobId, delay, err)
+		backendRetries.Inc()
+		time.Sleep(delay)
+	}
+}
+
+// delay returns the backoff before retrying after attempt, between half and all of the exponential backoff so
+// the retries of concurrent requests don't hit the backend at once
+func (p *RetryingCredentialsProvider) delay(attempt int) time.Duration {
+	backoff := p.backoff
+	for i := 0; i < attempt && backoff < p.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.maxBackoff {
+		backoff = p.maxBackoff
+	}
+
+	if backoff <= 1 {
+		return backoff
+	}
+
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)))
+}
+
+// CheckBackend delegates to the provider, when it can check its backend
+func (p *RetryingCredentialsProvider) CheckBackend() error {
+	if checker, ok := p.provider.(BackendChecker); ok {
+		return checker.CheckBackend()
+	}
+
+	return nil
+}
+
+// NewCircuitBreaker opens after threshold consecutive failures, then lets a single request through every
+// cooldown to probe the backend, closing again once one succeeds.
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	breakerOpen.Set(0)
+	return &CircuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+type CircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mutex    sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// Allow tells if a request may be sent to the backend
+func (b *CircuitBreaker) Allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.failures < b.threshold {
+		return true
+	}
+
+	if b.probing || time.Since(b.openedAt) < b.cooldown {
+		return false
+	}
+
+	b.probing = true
+	return true
+}
+
+func (b *CircuitBreaker) Success() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.failures >= b.threshold {
+		log.Info("Credentials backend is back, circuit breaker closed")
+		breakerOpen.Set(0)
+	}
+
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *CircuitBreaker) Failure() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.failures++
+	b.probing = false
+	if b.failures < b.threshold {
+		return
+	}
+
+	if b.failures == b.threshold {
+		log.Warnf("Credentials backend failed %d times in a row, circuit breaker open for %s", b.failures, b.cooldown)
+		breakerOpen.Set(1)
+	}
+	b.openedAt = time.Now()
+}
@@ -0,0 +1,90 @@
+package http_test
+
+import (
+	"github.com/aws/amazon-ecs-agent/agent/credentials"
+	"github.com/go-errors/errors"
+	http_pkg "github.com/schibsted/mesos2iam/http"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// failingProvider fails with the errors in order, then returns credentials
+type failingProvider struct {
+	errors []error
+	calls  int
+}
+
+func (p *failingProvider) GetCredentials(jobId string) (*credentials.IAMRoleCredentials, error) {
+	p.calls++
+	if p.calls <= len(p.errors) {
+		return nil, p.errors[p.calls-1]
+	}
+
+	return &credentials.IAMRoleCredentials{RoleArn: "roleArn"}, nil
+}
+
+func unavailable() error {
+	return &http_pkg.CredentialsUnavailableError{Err: errors.New("connection refused")}
+}
+
+func TestRetryingCredentialsProviderRetriesUnavailableBackends(t *testing.T) {
+	backend := &failingProvider{errors: []error{unavailable(), unavailable()}}
+	provider := http_pkg.NewRetryingCredentialsProvider(backend, 2, time.Millisecond, 2*time.Millisecond, nil)
+
+	creds, err := provider.GetCredentials("job")
+
+	assert.NoError(t, err)
+	assert.Equal(t, "roleArn", creds.RoleArn)
+	assert.Equal(t, 3, backend.calls)
+}
+
+func TestRetryingCredentialsProviderGivesUpAfterTheRetries(t *testing.T) {
+	backend := &failingProvider{errors: []error{unavailable(), unavailable(), unavailable()}}
+	provider := http_pkg.NewRetryingCredentialsProvider(backend, 1, time.Millisecond, time.Millisecond, nil)
+
+	_, err := provider.GetCredentials("job")
+
+	assert.IsType(t, &http_pkg.CredentialsUnavailableError{}, err)
+	assert.Equal(t, 2, backend.calls)
+}
+
+func TestRetryingCredentialsProviderDoesNotRetryOtherErrors(t *testing.T) {
+	backend := &failingProvider{errors: []error{&http_pkg.CredentialsNotFoundError{JobId: "job"}}}
+	provider := http_pkg.NewRetryingCredentialsProvider(backend, 2, time.Millisecond, time.Millisecond, nil)
+
+	_, err := provider.GetCredentials("job")
+
+	assert.IsType(t, &http_pkg.CredentialsNotFoundError{}, err)
+	assert.Equal(t, 1, backend.calls)
+}
+
+func TestCircuitBreakerFailsFastWhileTheBackendIsDown(t *testing.T) {
+	backend := &failingProvider{errors: []error{unavailable(), unavailable(), unavailable()}}
+	breaker := http_pkg.NewCircuitBreaker(2, 20*time.Millisecond)
+	provider := http_pkg.NewRetryingCredentialsProvider(backend, 0, time.Millisecond, time.Millisecond, breaker)
+
+	provider.GetCredentials("job")
+	provider.GetCredentials("job")
+	_, err := provider.GetCredentials("job")
+
+	if assert.Error(t, err) {
+		assert.Equal(t, "Credentials unavailable: circuit breaker open, backend considered down", err.Error())
+	}
+	assert.Equal(t, 2, backend.calls)
+
+	// The probe after the cooldown fails and opens the breaker again
+	time.Sleep(25 * time.Millisecond)
+	provider.GetCredentials("job")
+	assert.Equal(t, 3, backend.calls)
+	provider.GetCredentials("job")
+	assert.Equal(t, 3, backend.calls)
+
+	time.Sleep(25 * time.Millisecond)
+	creds, err := provider.GetCredentials("job")
+	assert.NoError(t, err)
+	assert.Equal(t, "roleArn", creds.RoleArn)
+
+	provider.GetCredentials("job")
+	assert.Equal(t, 5, backend.calls)
+}
@@ -0,0 +1,59 @@
+package http
+
+import (
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"net/http"
+	"time"
+)
+
+// Headers identifying the agent doing the requests to the credentials backend, signed with the request
+const (
+	InstanceIdHeader = "X-Mesos2iam-Instance-Id"
+	HostIpHeader     = "X-Mesos2iam-Host-Ip"
+)
+
+// NewRequestSigner signs the requests to the credentials backend with SigV4 for service in region, using
+// creds, usually the ones of the instance role of the agent, so the backend can check they come from an
+// agent. The identity headers, e.g. InstanceIdHeader and HostIpHeader, are added to every request.
+func NewRequestSigner(creds *credentials.Credentials, service, region string, identity map[string]string) *RequestSigner {
+	return &RequestSigner{v4.NewSigner(creds), service, region, identity}
+}
+
+type RequestSigner struct {
+	signer   *v4.Signer
+	service  string
+	region   string
+	identity map[string]string
+}
+
+// RoundTripper signs the requests before sending them with next
+func (s *RequestSigner) RoundTripper(next http.RoundTripper) http.RoundTripper {
+	return &signingRoundTripper{s, next}
+}
+
+type signingRoundTripper struct {
+	signer *RequestSigner
+	next   http.RoundTripper
+}
+
+// RoundTrip signs a copy of the request, round trippers mustn't modify the requests they are given. Requests
+// to the backend don't have a body.
+func (t *signingRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	signed := new(http.Request)
+	*signed = *r
+	signed.Header = http.Header{}
+	for name, values := range r.Header {
+		signed.Header[name] = append([]string{}, values...)
+	}
+
+	for name, value := range t.signer.identity {
+		signed.Header.Set(name, value)
+	}
+
+	if _, err := t.signer.signer.Sign(signed, nil, t.signer.service, t.signer.region, time.Now()); err != nil {
+		return nil, err
+	}
+
+	return t.next.RoundTrip(signed)
+}
@@ -0,0 +1,40 @@
+package http_test
+
+import (
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	http_pkg "github.com/schibsted/mesos2iam/http"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestSignerSignsTheRequestsWithTheAgentIdentity(t *testing.T) {
+	var received http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+	}))
+	defer backend.Close()
+
+	signer := http_pkg.NewRequestSigner(credentials.NewStaticCredentials("AKID", "SECRET", "SESSION"), "execute-api", "eu-west-1", map[string]string{
+		http_pkg.InstanceIdHeader: "i-0123456789abcdef0",
+		http_pkg.HostIpHeader:     "10.0.0.1",
+	})
+	netClient := &http.Client{Transport: signer.RoundTripper(http.DefaultTransport)}
+
+	req, _ := http.NewRequest("GET", backend.URL+"/credentials/job", nil)
+	_, err := netClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	authorization := received.Get("Authorization")
+	assert.True(t, strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential=AKID/"), authorization)
+	assert.Contains(t, authorization, "/eu-west-1/execute-api/aws4_request")
+	assert.Contains(t, authorization, "x-mesos2iam-host-ip;x-mesos2iam-instance-id")
+	assert.Equal(t, "SESSION", received.Get("X-Amz-Security-Token"))
+	assert.Equal(t, "i-0123456789abcdef0", received.Get(http_pkg.InstanceIdHeader))
+	assert.Equal(t, "10.0.0.1", received.Get(http_pkg.HostIpHeader))
+	assert.Empty(t, req.Header.Get("Authorization"), "the request of the caller is left untouched")
+}
@@ -0,0 +1,174 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/amazon-ecs-agent/agent/credentials"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"github.com/go-errors/errors"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Role session names are limited to 64 characters by STS
+const maxRoleSessionNameLength = 64
+
+// Matches the characters STS doesn't allow in role session names
+var invalidRoleSessionNameChars = regexp.MustCompile(`[^\w+=,.@-]`)
+
+// RoleArnResolver returns the ARN of the role a job has to assume.
+type RoleArnResolver interface {
+	RoleArn(jobId string) (string, error)
+}
+
+// NewTemplateRoleArnResolver builds role ARNs from a text/template receiving the job id as .JobId, e.g.
+// "arn:aws:iam::123456789012:role/mesos-{{.JobId}}"
+func NewTemplateRoleArnResolver(roleArnTemplate string) (*TemplateRoleArnResolver, error) {
+	tmpl, err := template.New("role-arn").Option("missingkey=error").Parse(roleArnTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TemplateRoleArnResolver{tmpl}, nil
+}
+
+type TemplateRoleArnResolver struct {
+	template *template.Template
+}
+
+// RoleArn refuses job ids holding a slash, which would put the role in another path than the one of the
+// template
+func (r *TemplateRoleArnResolver) RoleArn(jobId string) (string, error) {
+	if strings.Contains(jobId, "/") {
+		return "", errors.Errorf("JobId %s can't be used in a role ARN, it contains a /", jobId)
+	}
+
+	var roleArn bytes.Buffer
+	if err := r.template.Execute(&roleArn, struct{ JobId string }{jobId}); err != nil {
+		return "", err
+	}
+
+	return roleArn.String(), nil
+}
+
+// NewTableRoleArnResolverFromFile loads a JSON object mapping job ids to role ARNs.
+func NewTableRoleArnResolverFromFile(path string) (*TableRoleArnResolver, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	roles := map[string]string{}
+	if err := json.Unmarshal(buf, &roles); err != nil {
+		return nil, errors.Errorf("Invalid role table %s: %s", path, err)
+	}
+
+	return &TableRoleArnResolver{roles}, nil
+}
+
+type TableRoleArnResolver struct {
+	roles map[string]string
+}
+
+func (r *TableRoleArnResolver) RoleArn(jobId string) (string, error) {
+	roleArn, ok := r.roles[jobId]
+	if !ok {
+		return "", &CredentialsNotFoundError{jobId}
+	}
+
+	return roleArn, nil
+}
+
+func NewSTSCredentialsProvider(client stsiface.STSAPI, resolver RoleArnResolver, sessionDuration time.Duration) *STSCredentialsProvider {
+	return &STSCredentialsProvider{
+		client,
+		resolver,
+		sessionDuration,
+	}
+}
+
+// STSCredentialsProvider assumes the role of the job with the credentials of the agent's instance role.
+type STSCredentialsProvider struct {
+	sts             stsiface.STSAPI
+	resolver        RoleArnResolver
+	sessionDuration time.Duration
+}
+
+func (p *STSCredentialsProvider) GetCredentials(jobId string) (*credentials.IAMRoleCredentials, error) {
+	roleArn, err := p.resolver.RoleArn(jobId)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("Assuming role %s for JobId %s", roleArn, jobId)
+
+	output, err := p.sts.AssumeRole(&sts.AssumeRoleInput{
+		RoleArn:         aws.String(roleArn),
+		RoleSessionName: aws.String(roleSessionName(jobId)),
+		DurationSeconds: aws.Int64(int64(p.sessionDuration.Seconds())),
+	})
+	if err != nil {
+		return nil, assumeRoleError(jobId, roleArn, err)
+	}
+
+	return &credentials.IAMRoleCredentials{
+		RoleArn:         roleArn,
+		AccessKeyID:     aws.StringValue(output.Credentials.AccessKeyId),
+		SecretAccessKey: aws.StringValue(output.Credentials.SecretAccessKey),
+		SessionToken:    aws.StringValue(output.Credentials.SessionToken),
+		Expiration:      aws.TimeValue(output.Credentials.Expiration).UTC().Format(time.RFC3339),
+	}, nil
+}
+
+// CheckBackend fails when STS can't be reached with the credentials of the agent
+func (p *STSCredentialsProvider) CheckBackend() error {
+	_, err := p.sts.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	return err
+}
+
+// assumeRoleError types the errors of AssumeRole. Only throttling, server and network errors make the
+// credentials unavailable, the others are specific to the role of the job and mustn't be retried nor count as
+// failures of STS.
+func assumeRoleError(jobId, roleArn string, err error) error {
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case "AccessDenied", "NoSuchEntity":
+			log.Warnf("Can't assume role %s for JobId %s: %s", roleArn, jobId, err)
+			return &CredentialsNotFoundError{jobId}
+		case "ValidationError", "MalformedPolicyDocument", "PackedPolicyTooLarge", "RegionDisabledException":
+			return &InvalidCredentialsError{err}
+		}
+	}
+
+	if request.IsErrorThrottle(err) {
+		return &CredentialsUnavailableError{err}
+	}
+
+	if failure, ok := err.(awserr.RequestFailure); ok {
+		status := failure.StatusCode()
+		if status < http.StatusInternalServerError && status != http.StatusTooManyRequests {
+			return &InvalidCredentialsError{err}
+		}
+	}
+
+	return &CredentialsUnavailableError{err}
+}
+
+// roleSessionName names the session after the job, replacing the characters STS doesn't allow with a -
+func roleSessionName(jobId string) string {
+	sessionName := "mesos2iam-" + invalidRoleSessionNameChars.ReplaceAllString(jobId, "-")
+	if len(sessionName) > maxRoleSessionNameLength {
+		return sessionName[:maxRoleSessionNameLength]
+	}
+
+	return sessionName
+}
@@ -0,0 +1,156 @@
+package http_test
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	http_pkg "github.com/schibsted/mesos2iam/http"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+type MockedSTS struct {
+	stsiface.STSAPI
+	mock.Mock
+}
+
+func (m *MockedSTS) AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	args := m.Called(aws.StringValue(input.RoleArn), aws.StringValue(input.RoleSessionName))
+	return args.Get(0).(*sts.AssumeRoleOutput), args.Error(1)
+}
+
+func TestSTSCredentialsProviderAssumesRoleFromTemplate(t *testing.T) {
+	jobId := "4ea13548-caa8-48dc-af69-58a651d9fa3b"
+	roleArn := "arn:aws:iam::123456789012:role/mesos-" + jobId
+	expiration := time.Date(2017, 8, 1, 21, 6, 6, 0, time.UTC)
+
+	mockedSTS := &MockedSTS{}
+	mockedSTS.On("AssumeRole", roleArn, "mesos2iam-"+jobId).Return(&sts.AssumeRoleOutput{
+		Credentials: &sts.Credentials{
+			AccessKeyId:     aws.String("AccessKey"),
+			SecretAccessKey: aws.String("Secret"),
+			SessionToken:    aws.String("Token"),
+			Expiration:      aws.Time(expiration),
+		},
+	}, nil)
+
+	resolver, err := http_pkg.NewTemplateRoleArnResolver("arn:aws:iam::123456789012:role/mesos-{{.JobId}}")
+	assert.NoError(t, err)
+
+	provider := http_pkg.NewSTSCredentialsProvider(mockedSTS, resolver, time.Hour)
+	creds, err := provider.GetCredentials(jobId)
+
+	assert.NoError(t, err)
+	assert.Equal(t, roleArn, creds.RoleArn)
+	assert.Equal(t, "AccessKey", creds.AccessKeyID)
+	assert.Equal(t, "Secret", creds.SecretAccessKey)
+	assert.Equal(t, "Token", creds.SessionToken)
+	assert.Equal(t, "2017-08-01T21:06:06Z", creds.Expiration)
+	mockedSTS.AssertExpectations(t)
+}
+
+func TestSTSCredentialsProviderSanitizesTheRoleSessionName(t *testing.T) {
+	mockedSTS := &MockedSTS{}
+	mockedSTS.On("AssumeRole", "arn:aws:iam::123456789012:role/mesos-team:job id", "mesos2iam-team-job-id").Return(&sts.AssumeRoleOutput{
+		Credentials: &sts.Credentials{
+			AccessKeyId:     aws.String("AccessKey"),
+			SecretAccessKey: aws.String("Secret"),
+			SessionToken:    aws.String("Token"),
+			Expiration:      aws.Time(time.Now().Add(time.Hour)),
+		},
+	}, nil)
+
+	resolver, err := http_pkg.NewTemplateRoleArnResolver("arn:aws:iam::123456789012:role/mesos-{{.JobId}}")
+	assert.NoError(t, err)
+
+	_, err = http_pkg.NewSTSCredentialsProvider(mockedSTS, resolver, time.Hour).GetCredentials("team:job id")
+
+	assert.NoError(t, err)
+	mockedSTS.AssertExpectations(t)
+}
+
+func TestTemplateRoleArnResolverRefusesJobIdsWithSlashes(t *testing.T) {
+	resolver, err := http_pkg.NewTemplateRoleArnResolver("arn:aws:iam::123456789012:role/mesos/{{.JobId}}")
+	assert.NoError(t, err)
+
+	_, err = resolver.RoleArn("../admin")
+	assert.Error(t, err)
+}
+
+func TestTableRoleArnResolver(t *testing.T) {
+	file, err := ioutil.TempFile("", "roles")
+	assert.NoError(t, err)
+	defer os.Remove(file.Name())
+
+	file.WriteString(`{"my-job": "arn:aws:iam::123456789012:role/my-role"}`)
+	file.Close()
+
+	resolver, err := http_pkg.NewTableRoleArnResolverFromFile(file.Name())
+	assert.NoError(t, err)
+
+	roleArn, err := resolver.RoleArn("my-job")
+	assert.NoError(t, err)
+	assert.Equal(t, "arn:aws:iam::123456789012:role/my-role", roleArn)
+
+	_, err = resolver.RoleArn("unknown-job")
+	assert.Error(t, err)
+}
+
+func TestSTSCredentialsProviderTypesAssumeRoleErrors(t *testing.T) {
+	resolver, err := http_pkg.NewTemplateRoleArnResolver("arn:aws:iam::123456789012:role/{{.JobId}}")
+	assert.NoError(t, err)
+
+	for _, test := range []struct {
+		err      error
+		expected error
+	}{
+		{awserr.NewRequestFailure(awserr.New("AccessDenied", "not authorized", nil), 403, "id"), &http_pkg.CredentialsNotFoundError{}},
+		{awserr.NewRequestFailure(awserr.New("NoSuchEntity", "no role", nil), 404, "id"), &http_pkg.CredentialsNotFoundError{}},
+		{awserr.NewRequestFailure(awserr.New("ValidationError", "invalid arn", nil), 400, "id"), &http_pkg.InvalidCredentialsError{}},
+		{awserr.NewRequestFailure(awserr.New("Throttling", "rate exceeded", nil), 400, "id"), &http_pkg.CredentialsUnavailableError{}},
+		{awserr.NewRequestFailure(awserr.New("InternalFailure", "oops", nil), 500, "id"), &http_pkg.CredentialsUnavailableError{}},
+		{awserr.New("RequestError", "send request failed", nil), &http_pkg.CredentialsUnavailableError{}},
+	} {
+		mockedSTS := &MockedSTS{}
+		mockedSTS.On("AssumeRole", "arn:aws:iam::123456789012:role/job", "mesos2iam-job").Return((*sts.AssumeRoleOutput)(nil), test.err)
+
+		_, err := http_pkg.NewSTSCredentialsProvider(mockedSTS, resolver, time.Hour).GetCredentials("job")
+
+		assert.IsType(t, test.expected, err, test.err.Error())
+	}
+}
+
+func TestSTSCredentialsProviderAccessDeniedDoesNotOpenTheCircuitBreaker(t *testing.T) {
+	resolver, err := http_pkg.NewTemplateRoleArnResolver("arn:aws:iam::123456789012:role/{{.JobId}}")
+	assert.NoError(t, err)
+
+	mockedSTS := &MockedSTS{}
+	mockedSTS.On("AssumeRole", "arn:aws:iam::123456789012:role/bad-trust-policy", "mesos2iam-bad-trust-policy").Return(
+		(*sts.AssumeRoleOutput)(nil), awserr.NewRequestFailure(awserr.New("AccessDenied", "not authorized", nil), 403, "id"))
+	mockedSTS.On("AssumeRole", "arn:aws:iam::123456789012:role/good-job", "mesos2iam-good-job").Return(&sts.AssumeRoleOutput{
+		Credentials: &sts.Credentials{
+			AccessKeyId:     aws.String("AccessKey"),
+			SecretAccessKey: aws.String("Secret"),
+			SessionToken:    aws.String("Token"),
+			Expiration:      aws.Time(time.Now().Add(time.Hour)),
+		},
+	}, nil)
+
+	breaker := http_pkg.NewCircuitBreaker(2, time.Minute)
+	provider := http_pkg.NewRetryingCredentialsProvider(http_pkg.NewSTSCredentialsProvider(mockedSTS, resolver, time.Hour), 2, time.Millisecond, time.Millisecond, breaker)
+
+	for i := 0; i < 3; i++ {
+		_, err := provider.GetCredentials("bad-trust-policy")
+		assert.IsType(t, &http_pkg.CredentialsNotFoundError{}, err)
+	}
+	mockedSTS.AssertNumberOfCalls(t, "AssumeRole", 3)
+
+	creds, err := provider.GetCredentials("good-job")
+	assert.NoError(t, err)
+	assert.Equal(t, "AccessKey", creds.AccessKeyID)
+}
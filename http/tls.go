@@ -0,0 +1,204 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-errors/errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// NewTLSConfigLoader loads the TLS configuration of the connections to the credentials backend: the client
+// certificate authenticating mesos2iam (certFile and keyFile), the CA bundle verifying the backend instead of
+// the system roots (caFile), the name expected in the certificate of the backend instead of its host
+// (serverName) and the minimum TLS version (1.0, 1.1, 1.2 or 1.3). Empty values keep the defaults.
+func NewTLSConfigLoader(certFile, keyFile, caFile, serverName, minVersion string) (*TLSConfigLoader, error) {
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, errors.Errorf("Unknown TLS version \"%s\", must be 1.0, 1.1, 1.2 or 1.3", minVersion)
+	}
+
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("The client certificate and key must be set together")
+	}
+
+	loader := &TLSConfigLoader{
+		certFile:   certFile,
+		keyFile:    keyFile,
+		caFile:     caFile,
+		serverName: serverName,
+		minVersion: version,
+		modTimes:   map[string]time.Time{},
+	}
+	if err := loader.Reload(); err != nil {
+		return nil, err
+	}
+
+	return loader, nil
+}
+
+// TLSConfigLoader reloads the certificate, key and CA bundle when they change on disk, e.g. when they are
+// renewed, so new connections use them without restarting mesos2iam. The client certificate is read at every
+// handshake, while the transport verifying the backends is replaced when the CA bundle is reloaded.
+type TLSConfigLoader struct {
+	certFile   string
+	keyFile    string
+	caFile     string
+	serverName string
+	minVersion uint16
+
+	mutex       sync.RWMutex
+	modTimes    map[string]time.Time
+	certificate *tls.Certificate
+	transport   *http.Transport
+}
+
+// Start reloads the files every interval when they have changed, until stop is closed. Files that can't be
+// loaded are logged and the previous ones are kept.
+func (l *TLSConfigLoader) Start(interval time.Duration, stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := l.Reload(); err != nil {
+					log.Error("Couldn't reload TLS files: ", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Reload loads the files again if any of them has been modified since they were loaded
+func (l *TLSConfigLoader) Reload() error {
+	modTimes := map[string]time.Time{}
+	changed := false
+	for _, path := range []string{l.certFile, l.keyFile, l.caFile} {
+		if path == "" {
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+
+		modTimes[path] = info.ModTime()
+		l.mutex.RLock()
+		changed = changed || !info.ModTime().Equal(l.modTimes[path])
+		l.mutex.RUnlock()
+	}
+
+	if !changed {
+		return nil
+	}
+
+	var certificate *tls.Certificate
+	if l.certFile != "" {
+		loaded, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+		if err != nil {
+			return errors.Errorf("Invalid client certificate %s: %s", l.certFile, err)
+		}
+		certificate = &loaded
+	}
+
+	var rootCAs *x509.CertPool
+	if l.caFile != "" {
+		buf, err := ioutil.ReadFile(l.caFile)
+		if err != nil {
+			return err
+		}
+
+		rootCAs = x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(buf) {
+			return errors.Errorf("No certificate found in CA bundle %s", l.caFile)
+		}
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	caChanged := !modTimes[l.caFile].Equal(l.modTimes[l.caFile])
+	l.modTimes = modTimes
+	l.certificate = certificate
+	if l.transport == nil || caChanged {
+		if l.transport != nil {
+			l.transport.CloseIdleConnections()
+		}
+		l.transport = l.newTransport(rootCAs)
+	}
+
+	log.Info("Loaded TLS configuration of the credentials backend")
+	return nil
+}
+
+// Config returns the TLS configuration of the connections verifying the backends with rootCAs, the system
+// roots when nil, and reading the client certificate currently loaded at every handshake
+func (l *TLSConfigLoader) Config(rootCAs *x509.CertPool) *tls.Config {
+	config := &tls.Config{
+		MinVersion: l.minVersion,
+		RootCAs:    rootCAs,
+		ServerName: l.serverName,
+	}
+	if l.certFile != "" {
+		config.GetClientCertificate = l.clientCertificate
+	}
+
+	return config
+}
+
+// clientCertificate returns the client certificate currently loaded
+func (l *TLSConfigLoader) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	if l.certificate == nil {
+		return &tls.Certificate{}, nil
+	}
+
+	return l.certificate, nil
+}
+
+// newTransport returns an http.Transport opening every TLS connection, proxied or not, with Config. The
+// transport sets the host of the URL as server name unless it is overridden.
+func (l *TLSConfigLoader) newTransport(rootCAs *x509.CertPool) *http.Transport {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+
+	return &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dialer.DialContext,
+		TLSClientConfig:     l.Config(rootCAs),
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+	}
+}
+
+// Transport returns the RoundTripper sending every request with the transport of the files currently loaded
+func (l *TLSConfigLoader) Transport() http.RoundTripper {
+	return l
+}
+
+// RoundTrip sends the request with the transport of the CA bundle currently loaded
+func (l *TLSConfigLoader) RoundTrip(request *http.Request) (*http.Response, error) {
+	l.mutex.RLock()
+	transport := l.transport
+	l.mutex.RUnlock()
+
+	return transport.RoundTrip(request)
+}
@@ -0,0 +1,189 @@
+package http_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	http_pkg "github.com/schibsted/mesos2iam/http"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	certPEM     []byte
+	keyPEM      []byte
+}
+
+// newTestCertificate creates a certificate signed by parent, or a self-signed CA when parent is nil
+func newTestCertificate(t *testing.T, name string, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	if ip := net.ParseIP(name); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{name}
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.certificate, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	return &testCertificate{
+		certificate,
+		key,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}
+}
+
+func writeTestFile(t *testing.T, path string, content []byte, modTime time.Time) {
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(path, modTime, modTime)
+}
+
+func TestTLSConfigLoaderAuthenticatesToTheBackend(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+
+	ca := newTestCertificate(t, "ca", nil)
+	otherCa := newTestCertificate(t, "other-ca", nil)
+	server := newTestCertificate(t, "backend.test", ca)
+	client := newTestCertificate(t, "mesos2iam", ca)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.certificate)
+	serverCertificate, _ := tls.X509KeyPair(server.certPEM, server.keyPEM)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	backend.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCertificate},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	backend.StartTLS()
+	defer backend.Close()
+
+	certFile, keyFile, caFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")
+	writeTestFile(t, certFile, client.certPEM, time.Now().Add(-time.Minute))
+	writeTestFile(t, keyFile, client.keyPEM, time.Now().Add(-time.Minute))
+	writeTestFile(t, caFile, otherCa.certPEM, time.Now().Add(-time.Minute))
+
+	loader, err := http_pkg.NewTLSConfigLoader(certFile, keyFile, caFile, "backend.test", "1.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	netClient := &http.Client{Timeout: 5 * time.Second, Transport: loader.Transport()}
+
+	_, err = netClient.Get(backend.URL)
+	assert.Error(t, err, "the backend isn't signed by the CA bundle")
+
+	writeTestFile(t, caFile, ca.certPEM, time.Now())
+	assert.NoError(t, loader.Reload())
+
+	response, err := netClient.Get(backend.URL)
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		assert.Equal(t, "mesos2iam", string(body))
+	}
+
+	renewed := newTestCertificate(t, "mesos2iam-renewed", ca)
+	writeTestFile(t, certFile, renewed.certPEM, time.Now().Add(time.Minute))
+	writeTestFile(t, keyFile, renewed.keyPEM, time.Now().Add(time.Minute))
+	assert.NoError(t, loader.Reload())
+	backend.CloseClientConnections()
+
+	response, err = netClient.Get(backend.URL)
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		assert.Equal(t, "mesos2iam-renewed", string(body))
+	}
+}
+
+func TestTLSConfigLoaderRejectsInvalidSettings(t *testing.T) {
+	_, err := http_pkg.NewTLSConfigLoader("", "", "", "", "1.4")
+	assert.EqualError(t, err, "Unknown TLS version \"1.4\", must be 1.0, 1.1, 1.2 or 1.3")
+
+	_, err = http_pkg.NewTLSConfigLoader("cert.pem", "", "", "", "1.2")
+	assert.EqualError(t, err, "The client certificate and key must be set together")
+}
+
+func TestTLSConfigLoaderVerifiesTheHostOfTheBackend(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+
+	ca := newTestCertificate(t, "ca", nil)
+	caFile := filepath.Join(dir, "ca.pem")
+	writeTestFile(t, caFile, ca.certPEM, time.Now())
+
+	newBackend := func(name string) *httptest.Server {
+		server := newTestCertificate(t, name, ca)
+		serverCertificate, _ := tls.X509KeyPair(server.certPEM, server.keyPEM)
+		backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		backend.TLS = &tls.Config{Certificates: []tls.Certificate{serverCertificate}}
+		backend.StartTLS()
+		return backend
+	}
+
+	loader, err := http_pkg.NewTLSConfigLoader("", "", caFile, "", "1.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	netClient := &http.Client{Timeout: 5 * time.Second, Transport: loader.Transport()}
+
+	backend := newBackend("127.0.0.1")
+	defer backend.Close()
+	response, err := netClient.Get(backend.URL)
+	if assert.NoError(t, err) {
+		response.Body.Close()
+		assert.Equal(t, uint16(tls.VersionTLS13), response.TLS.Version)
+	}
+
+	otherBackend := newBackend("backend.test")
+	defer otherBackend.Close()
+	_, err = netClient.Get(otherBackend.URL)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "127.0.0.1", "the certificate of the backend doesn't match its host")
+	}
+}
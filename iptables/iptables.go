@@ -2,52 +2,384 @@ package iptables
 
 import (
 	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
 	"github.com/coreos/go-iptables/iptables"
+	"github.com/schibsted/mesos2iam/firewall"
+	"net"
+	"os/exec"
+	"strings"
 )
 
-// AddRules adds the required rules to the host's nat table
-func AddRules(appPort, metadataAddress, hostIp string) error {
+const (
+	table = "nat"
+	// Chains owned by mesos2iam, jumped to from the first rule of PREROUTING and OUTPUT of the nat table
+	PreroutingChain = "MESOS2IAM-PREROUTING"
+	OutputChain     = "MESOS2IAM-OUTPUT"
+	// Chain of the filter table blocking the EC2 instance metadata service, jumped to from FORWARD
+	ForwardChain = "MESOS2IAM-FORWARD"
+)
+
+// jump goes from the first rule of parent to our chain
+type jump struct {
+	table  string
+	parent string
+	chain  string
+}
+
+var (
+	natJumps    = []jump{{table, "PREROUTING", PreroutingChain}, {table, "OUTPUT", OutputChain}}
+	forwardJump = jump{"filter", "FORWARD", ForwardChain}
+	allJumps    = append(natJumps, forwardJump)
+)
+
+// IPTables is the part of *iptables.IPTables managing the rules, so they can be tested without iptables
+type IPTables interface {
+	Exists(table, chain string, rulespec ...string) (bool, error)
+	Insert(table, chain string, pos int, rulespec ...string) error
+	Append(table, chain string, rulespec ...string) error
+	Delete(table, chain string, rulespec ...string) error
+	List(table, chain string) ([]string, error)
+	ListChains(table string) ([]string, error)
+	ClearChain(table, chain string) error
+	DeleteChain(table, chain string) error
+}
+
+// IsLegacy tells if the iptables command is installed and isn't the nf_tables variant translating the rules
+// to nftables
+func IsLegacy() bool {
+	out, err := exec.Command("iptables", "--version").Output()
+	return err == nil && !strings.Contains(string(out), "nf_tables")
+}
+
+// NewRules creates the rules redirecting the requests to credentialsAddress, and to ec2MetadataAddress unless
+// it's empty, to mesos2iam listening on hostIp:appPort, and dropping the traffic of the containers to the
+// EC2 instance metadata service not redirected to mesos2iam unless block is nil. The rules are set with
+// ip6tables when ipv6 is true, and all the addresses and CIDRs must be of that family.
+func NewRules(ipv6 bool, appPort, hostIp, credentialsAddress, ec2MetadataAddress string, block *firewall.MetadataBlock) (*Rules, error) {
 	if hostIp == "" {
-		return errors.New("--host-ip must be set")
+		return nil, errors.New("--host-ip must be set")
 	}
 
-	ipt, err := iptables.New()
-	if err != nil {
-		return err
+	if err := firewall.CheckFamily(ipv6, block, hostIp, credentialsAddress, ec2MetadataAddress); err != nil {
+		return nil, err
 	}
 
-	table := "nat"
+	protocol := iptables.ProtocolIPv4
+	if ipv6 {
+		protocol = iptables.ProtocolIPv6
+	}
 
-	rulespec := []string{"-p", "tcp",
-		"-d", metadataAddress,
-		"--dport", "80",
-		"-j", "DNAT",
-		"--to-destination", hostIp + ":" + appPort}
-	err = insertIfDoesNotExist(ipt, table, "PREROUTING", 1, rulespec)
+	ipt, err := iptables.NewWithProtocol(protocol)
 	if err != nil {
+		return nil, err
+	}
+
+	return &Rules{ipt, appPort, hostIp, credentialsAddress, ec2MetadataAddress, block}, nil
+}
+
+// Rules are kept in the PreroutingChain and OutputChain chains of the nat table, of ip6tables for the rules
+// of the IPv6 addresses.
+//
+// The requests of containers in bridge mode are sent to mesos2iam from PreroutingChain, the ones of host
+// processes from OutputChain. Only the traffic of containers to the EC2 instance metadata service is
+// redirected; the host processes, including mesos2iam itself, keep reaching the real metadata service.
+//
+// With a MetadataBlock, the traffic of the containers to the metadata service still addressed to it after
+// PreroutingChain is dropped in ForwardChain of the filter table. Host processes don't go through FORWARD.
+type Rules struct {
+	ipt                IPTables
+	appPort            string
+	hostIp             string
+	credentialsAddress string
+	ec2MetadataAddress string
+	block              *firewall.MetadataBlock
+}
+
+var _ firewall.Rules = &Rules{}
+
+// jumps returns the jumps to the chains in use
+func (r *Rules) jumps() []jump {
+	if r.block == nil {
+		return natJumps
+	}
+
+	return allJumps
+}
+
+// chainRules returns the rules of each of our chains
+func (r *Rules) chainRules() map[string][][]string {
+	return map[string][][]string{
+		PreroutingChain: r.dnatRules(),
+		OutputChain:     {redirectRulespec(r.appPort, r.credentialsAddress)},
+		ForwardChain:    r.blockRules(),
+	}
+}
+
+func (r *Rules) blockRules() [][]string {
+	if r.block == nil {
+		return nil
+	}
+
+	rules := [][]string{}
+	for _, iface := range r.block.Interfaces {
+		rules = append(rules, []string{"-i", iface, "-d", r.block.Address, "-j", "DROP"})
+	}
+	for _, cidr := range r.block.CIDRs {
+		rules = append(rules, []string{"-s", cidr, "-d", r.block.Address, "-j", "DROP"})
+	}
+
+	return rules
+}
+
+func (r *Rules) dnatRules() [][]string {
+	rules := [][]string{dnatRulespec(r.appPort, r.credentialsAddress, r.hostIp)}
+	if r.ec2MetadataAddress != "" {
+		rules = append(rules, dnatRulespec(r.appPort, r.ec2MetadataAddress, r.hostIp))
+	}
+
+	return rules
+}
+
+// Apply creates our chains and the jumps to them, removing the rules added to PREROUTING and OUTPUT by
+// previous versions of mesos2iam
+func (r *Rules) Apply() error {
+	if err := r.deleteLegacyRules(); err != nil {
 		return err
 	}
 
-	rulespec = []string{"-p", "tcp",
-		"-m", "tcp",
-		"-d", metadataAddress,
-		"--dport", "80",
-		"-j", "REDIRECT", "--to-ports", appPort}
-	err = insertIfDoesNotExist(ipt, table, "OUTPUT", 1, rulespec)
-	if err != nil {
+	_, err := r.reconcile(false)
+	return err
+}
+
+// deleteLegacyRules removes the rules previous versions of mesos2iam inserted in PREROUTING and OUTPUT
+func (r *Rules) deleteLegacyRules() error {
+	for _, rulespec := range r.dnatRules() {
+		if err := deleteIfExists(r.ipt, table, "PREROUTING", rulespec); err != nil {
+			return err
+		}
+	}
+
+	return deleteIfExists(r.ipt, table, "OUTPUT", redirectRulespec(r.appPort, r.credentialsAddress))
+}
+
+// Reconcile restores the rules of our chains and the jumps to them when they are missing or aren't the
+// first rules of PREROUTING and OUTPUT anymore, e.g. after the Docker daemon or the firewall rewrote the nat
+// table. It returns the number of repairs.
+func (r *Rules) Reconcile() (int, error) {
+	return r.reconcile(true)
+}
+
+// reconcile logs and counts the repairs when they aren't the initial creation of the rules
+func (r *Rules) reconcile(repairing bool) (int, error) {
+	repaired := 0
+	logRepair := func(chain, format string, args ...interface{}) {
+		repaired++
+		if !repairing {
+			log.Infof(format, args...)
+			return
+		}
+
+		log.Warnf(format, args...)
+		firewall.CountRepair("iptables", chain)
+	}
+
+	for _, jump := range r.jumps() {
+		rules := r.chainRules()[jump.chain]
+		ok, err := r.chainHasRules(jump.table, jump.chain, rules)
+		if err != nil {
+			return repaired, err
+		}
+
+		if !ok {
+			if err := r.fillChain(jump.table, jump.chain, rules); err != nil {
+				return repaired, err
+			}
+			logRepair(jump.chain, "Rules of %s chain of %s table set", jump.chain, jump.table)
+		}
+	}
+
+	for _, jump := range r.jumps() {
+		first, err := r.jumpIsFirst(jump)
+		if err != nil {
+			return repaired, err
+		}
+
+		if !first {
+			if err := deleteIfExists(r.ipt, jump.table, jump.parent, jumpRulespec(jump.chain)); err != nil {
+				return repaired, err
+			}
+			if err := r.ipt.Insert(jump.table, jump.parent, 1, jumpRulespec(jump.chain)...); err != nil {
+				return repaired, err
+			}
+			logRepair(jump.parent, "Jump to %s set as first rule of %s chain of %s table", jump.chain, jump.parent, jump.table)
+		}
+	}
+
+	return repaired, nil
+}
+
+// Check fails when any rule is missing or misordered
+func (r *Rules) Check() error {
+	for _, jump := range r.jumps() {
+		ok, err := r.chainHasRules(jump.table, jump.chain, r.chainRules()[jump.chain])
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			return fmt.Errorf("Rules missing in %s chain of %s table", jump.chain, jump.table)
+		}
+
+		first, err := r.jumpIsFirst(jump)
+		if err != nil {
+			return err
+		}
+
+		if !first {
+			return fmt.Errorf("Jump to %s isn't the first rule of %s chain of %s table", jump.chain, jump.parent, jump.table)
+		}
+	}
+
+	return nil
+}
+
+// Clean removes the rules left by any version of mesos2iam
+func (r *Rules) Clean() error {
+	if err := r.deleteLegacyRules(); err != nil {
 		return err
 	}
 
+	return r.Delete()
+}
+
+// Delete removes the jumps to our chains and the chains, including ForwardChain when the metadata service
+// isn't blocked anymore
+func (r *Rules) Delete() error {
+	for _, jump := range allJumps {
+		// iptables fails to check a jump to a missing chain, which is already deleted with its jumps
+		exists, err := r.chainExists(jump.table, jump.chain)
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			continue
+		}
+
+		if err := deleteIfExists(r.ipt, jump.table, jump.parent, jumpRulespec(jump.chain)); err != nil {
+			return err
+		}
+		if err := r.ipt.ClearChain(jump.table, jump.chain); err != nil {
+			return err
+		}
+		if err := r.ipt.DeleteChain(jump.table, jump.chain); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func insertIfDoesNotExist(ipt *iptables.IPTables, table string, chain string, pos int, rulespec []string) error {
-	// These rules must be the first, otherwise, docker rules will override them.
-	if exists, _ := ipt.Exists(table, chain, rulespec...); !exists {
-		if err := ipt.Insert(table, chain, pos, rulespec...); err != nil {
+func (r *Rules) chainExists(table, chain string) (bool, error) {
+	chains, err := r.ipt.ListChains(table)
+	if err != nil {
+		return false, err
+	}
+
+	for _, existing := range chains {
+		if existing == chain {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (r *Rules) chainHasRules(table, chain string, rules [][]string) (bool, error) {
+	exists, err := r.chainExists(table, chain)
+	if err != nil || !exists {
+		return false, err
+	}
+
+	for _, rulespec := range rules {
+		if exists, err := r.ipt.Exists(table, chain, rulespec...); err != nil || !exists {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// fillChain creates the chain, or empties it, and appends the rules
+func (r *Rules) fillChain(table, chain string, rules [][]string) error {
+	if err := r.ipt.ClearChain(table, chain); err != nil {
+		return err
+	}
+
+	for _, rulespec := range rules {
+		if err := r.ipt.Append(table, chain, rulespec...); err != nil {
 			return err
 		}
 	}
 
 	return nil
 }
+
+// jumpIsFirst tells if the first rule of the parent chain is the jump. These jumps must be the first rules,
+// otherwise, docker rules will override them.
+func (r *Rules) jumpIsFirst(jump jump) (bool, error) {
+	rules, err := r.ipt.List(jump.table, jump.parent)
+	if err != nil {
+		return false, err
+	}
+
+	// The first line is the policy of the chain (-P PREROUTING ACCEPT)
+	for _, rule := range rules {
+		if strings.HasPrefix(rule, "-A ") {
+			return rule == "-A "+jump.parent+" "+strings.Join(jumpRulespec(jump.chain), " "), nil
+		}
+	}
+
+	return false, nil
+}
+
+func jumpRulespec(chain string) []string {
+	return []string{"-j", chain}
+}
+
+// dnatRulespec sends the requests of containers in bridge mode to address to mesos2iam
+func dnatRulespec(appPort, address, hostIp string) []string {
+	return []string{"-p", "tcp",
+		"-d", address,
+		"--dport", "80",
+		"-j", "DNAT",
+		"--to-destination", net.JoinHostPort(hostIp, appPort)}
+}
+
+// redirectRulespec sends the requests of host processes to address to mesos2iam
+func redirectRulespec(appPort, address string) []string {
+	return []string{"-p", "tcp",
+		"-m", "tcp",
+		"-d", address,
+		"--dport", "80",
+		"-j", "REDIRECT", "--to-ports", appPort}
+}
+
+func deleteIfExists(ipt IPTables, table string, chain string, rulespec []string) error {
+	// Delete every copy, in case the rule was inserted twice by concurrent runs
+	for {
+		exists, err := ipt.Exists(table, chain, rulespec...)
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			return nil
+		}
+
+		if err := ipt.Delete(table, chain, rulespec...); err != nil {
+			return err
+		}
+	}
+}
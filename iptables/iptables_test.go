@@ -0,0 +1,323 @@
+package iptables
+
+import (
+	"fmt"
+	"github.com/schibsted/mesos2iam/firewall"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+var builtinChains = map[string][]string{
+	"nat":    {"PREROUTING", "INPUT", "OUTPUT", "POSTROUTING"},
+	"filter": {"INPUT", "FORWARD", "OUTPUT"},
+}
+
+// fakeIPTables keeps the rules of every chain in memory, listing them like iptables -S
+type fakeIPTables struct {
+	chains map[string]map[string][]string
+	order  map[string][]string
+}
+
+func newFakeIPTables() *fakeIPTables {
+	fake := &fakeIPTables{map[string]map[string][]string{}, map[string][]string{}}
+	for table, chains := range builtinChains {
+		fake.chains[table] = map[string][]string{}
+		for _, chain := range chains {
+			fake.chains[table][chain] = []string{}
+			fake.order[table] = append(fake.order[table], chain)
+		}
+	}
+
+	return fake
+}
+
+func (f *fakeIPTables) rules(table, chain string) ([]string, error) {
+	rules, ok := f.chains[table][chain]
+	if !ok {
+		return nil, fmt.Errorf("No chain %s in table %s", chain, table)
+	}
+
+	return rules, nil
+}
+
+// targets are the targets of the rules of mesos2iam that aren't chains
+var targets = map[string]bool{"ACCEPT": true, "DROP": true, "DNAT": true, "REDIRECT": true}
+
+// checkTarget fails like iptables checking or deleting a rule jumping to a chain that doesn't exist
+func (f *fakeIPTables) checkTarget(table string, rulespec []string) error {
+	for i, arg := range rulespec {
+		if arg != "-j" || i+1 == len(rulespec) {
+			continue
+		}
+
+		target := rulespec[i+1]
+		if _, ok := f.chains[table][target]; !ok && !targets[target] {
+			return fmt.Errorf("Couldn't load target `%s':No such file or directory", target)
+		}
+	}
+
+	return nil
+}
+
+func (f *fakeIPTables) Exists(table, chain string, rulespec ...string) (bool, error) {
+	rules, err := f.rules(table, chain)
+	if err != nil {
+		return false, err
+	}
+
+	if err := f.checkTarget(table, rulespec); err != nil {
+		return false, err
+	}
+
+	for _, rule := range rules {
+		if rule == strings.Join(rulespec, " ") {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (f *fakeIPTables) Insert(table, chain string, pos int, rulespec ...string) error {
+	rules, err := f.rules(table, chain)
+	if err != nil {
+		return err
+	}
+
+	inserted := append([]string{}, rules[:pos-1]...)
+	inserted = append(inserted, strings.Join(rulespec, " "))
+	f.chains[table][chain] = append(inserted, rules[pos-1:]...)
+	return nil
+}
+
+func (f *fakeIPTables) Append(table, chain string, rulespec ...string) error {
+	rules, err := f.rules(table, chain)
+	if err != nil {
+		return err
+	}
+
+	f.chains[table][chain] = append(rules, strings.Join(rulespec, " "))
+	return nil
+}
+
+func (f *fakeIPTables) Delete(table, chain string, rulespec ...string) error {
+	rules, err := f.rules(table, chain)
+	if err != nil {
+		return err
+	}
+
+	if err := f.checkTarget(table, rulespec); err != nil {
+		return err
+	}
+
+	for i, rule := range rules {
+		if rule == strings.Join(rulespec, " ") {
+			f.chains[table][chain] = append(rules[:i:i], rules[i+1:]...)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Bad rule (does a matching rule exist in that chain?)")
+}
+
+func (f *fakeIPTables) List(table, chain string) ([]string, error) {
+	rules, err := f.rules(table, chain)
+	if err != nil {
+		return nil, err
+	}
+
+	listed := []string{"-N " + chain}
+	for _, builtin := range builtinChains[table] {
+		if builtin == chain {
+			listed = []string{"-P " + chain + " ACCEPT"}
+		}
+	}
+	for _, rule := range rules {
+		listed = append(listed, "-A "+chain+" "+rule)
+	}
+
+	return listed, nil
+}
+
+func (f *fakeIPTables) ListChains(table string) ([]string, error) {
+	return f.order[table], nil
+}
+
+func (f *fakeIPTables) ClearChain(table, chain string) error {
+	if _, ok := f.chains[table][chain]; !ok {
+		f.order[table] = append(f.order[table], chain)
+	}
+
+	f.chains[table][chain] = []string{}
+	return nil
+}
+
+func (f *fakeIPTables) DeleteChain(table, chain string) error {
+	rules, err := f.rules(table, chain)
+	if err != nil {
+		return err
+	}
+
+	if len(rules) > 0 {
+		return fmt.Errorf("Directory not empty")
+	}
+
+	delete(f.chains[table], chain)
+	for i, existing := range f.order[table] {
+		if existing == chain {
+			f.order[table] = append(f.order[table][:i:i], f.order[table][i+1:]...)
+		}
+	}
+
+	return nil
+}
+
+func newTestRules(block *firewall.MetadataBlock) (*Rules, *fakeIPTables) {
+	fake := newFakeIPTables()
+	return &Rules{fake, "51679", "10.0.0.1", "169.254.170.2", "169.254.169.254", block}, fake
+}
+
+const (
+	credentialsDnat     = "-p tcp -d 169.254.170.2 --dport 80 -j DNAT --to-destination 10.0.0.1:51679"
+	metadataDnat        = "-p tcp -d 169.254.169.254 --dport 80 -j DNAT --to-destination 10.0.0.1:51679"
+	credentialsRedirect = "-p tcp -m tcp -d 169.254.170.2 --dport 80 -j REDIRECT --to-ports 51679"
+	dockerRule          = "-m addrtype --dst-type LOCAL -j DOCKER"
+)
+
+func TestApplyCreatesTheChainsAndJumps(t *testing.T) {
+	rules, fake := newTestRules(nil)
+	// Rules of a previous version of mesos2iam
+	fake.Append("nat", "PREROUTING", dockerRule)
+	fake.Insert("nat", "PREROUTING", 1, strings.Split(credentialsDnat, " ")...)
+	fake.Append("nat", "OUTPUT", strings.Split(credentialsRedirect, " ")...)
+
+	assert.NoError(t, rules.Apply())
+
+	assert.Equal(t, []string{"-j " + PreroutingChain, dockerRule}, fake.chains["nat"]["PREROUTING"])
+	assert.Equal(t, []string{"-j " + OutputChain}, fake.chains["nat"]["OUTPUT"])
+	assert.Equal(t, []string{credentialsDnat, metadataDnat}, fake.chains["nat"][PreroutingChain])
+	assert.Equal(t, []string{credentialsRedirect}, fake.chains["nat"][OutputChain])
+	assert.NotContains(t, fake.chains["filter"], ForwardChain)
+	assert.NoError(t, rules.Check())
+}
+
+func TestApplyBlocksTheMetadataServiceInTheFilterTable(t *testing.T) {
+	rules, fake := newTestRules(&firewall.MetadataBlock{
+		Address:    "169.254.169.254",
+		Interfaces: []string{"docker0"},
+		CIDRs:      []string{"10.1.0.0/16"},
+	})
+
+	assert.NoError(t, rules.Apply())
+
+	assert.Equal(t, []string{"-j " + ForwardChain}, fake.chains["filter"]["FORWARD"])
+	assert.Equal(t, []string{
+		"-i docker0 -d 169.254.169.254 -j DROP",
+		"-s 10.1.0.0/16 -d 169.254.169.254 -j DROP",
+	}, fake.chains["filter"][ForwardChain])
+}
+
+func TestReconcileRestoresMissingRulesAndJumps(t *testing.T) {
+	rules, fake := newTestRules(nil)
+	assert.NoError(t, rules.Apply())
+
+	repaired, err := rules.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, repaired)
+
+	// The firewall flushed our chain, and Docker inserted its rule before the jump
+	fake.chains["nat"][PreroutingChain] = []string{}
+	fake.Insert("nat", "OUTPUT", 1, strings.Split(dockerRule, " ")...)
+	assert.Error(t, rules.Check())
+
+	repaired, err = rules.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, repaired)
+	assert.Equal(t, []string{credentialsDnat, metadataDnat}, fake.chains["nat"][PreroutingChain])
+	assert.Equal(t, []string{"-j " + OutputChain, dockerRule}, fake.chains["nat"]["OUTPUT"])
+	assert.NoError(t, rules.Check())
+}
+
+func TestReconcileRestoresDeletedChains(t *testing.T) {
+	rules, fake := newTestRules(nil)
+	assert.NoError(t, rules.Apply())
+
+	fake.Delete("nat", "OUTPUT", "-j", OutputChain)
+	fake.ClearChain("nat", OutputChain)
+	fake.DeleteChain("nat", OutputChain)
+
+	repaired, err := rules.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, repaired)
+	assert.Equal(t, []string{"-j " + OutputChain}, fake.chains["nat"]["OUTPUT"])
+	assert.Equal(t, []string{credentialsRedirect}, fake.chains["nat"][OutputChain])
+}
+
+func TestDeleteRemovesTheChainsAndJumps(t *testing.T) {
+	rules, fake := newTestRules(&firewall.MetadataBlock{Address: "169.254.169.254", Interfaces: []string{"docker0"}})
+	fake.Append("nat", "PREROUTING", dockerRule)
+	assert.NoError(t, rules.Apply())
+
+	assert.NoError(t, rules.Delete())
+
+	assert.Equal(t, []string{dockerRule}, fake.chains["nat"]["PREROUTING"])
+	assert.Empty(t, fake.chains["nat"]["OUTPUT"])
+	assert.Empty(t, fake.chains["filter"]["FORWARD"])
+	for _, chain := range []string{PreroutingChain, OutputChain} {
+		assert.NotContains(t, fake.chains["nat"], chain)
+	}
+	assert.NotContains(t, fake.chains["filter"], ForwardChain)
+
+	// Deleting rules already deleted succeeds
+	assert.NoError(t, rules.Delete())
+}
+
+func TestDeleteWithoutMetadataBlock(t *testing.T) {
+	rules, fake := newTestRules(nil)
+
+	// Nothing to delete before the rules are applied
+	assert.NoError(t, rules.Delete())
+
+	assert.NoError(t, rules.Apply())
+	assert.NoError(t, rules.Delete())
+
+	assert.Empty(t, fake.chains["nat"]["PREROUTING"])
+	assert.Empty(t, fake.chains["nat"]["OUTPUT"])
+	assert.NotContains(t, fake.chains["nat"], PreroutingChain)
+	assert.NotContains(t, fake.chains["nat"], OutputChain)
+}
+
+func TestCleanTwiceInARow(t *testing.T) {
+	rules, fake := newTestRules(&firewall.MetadataBlock{Address: "169.254.169.254", Interfaces: []string{"docker0"}})
+	assert.NoError(t, rules.Apply())
+
+	assert.NoError(t, rules.Clean())
+	assert.NoError(t, rules.Clean())
+
+	assert.Empty(t, fake.chains["nat"]["PREROUTING"])
+	assert.Empty(t, fake.chains["filter"]["FORWARD"])
+	assert.NotContains(t, fake.chains["filter"], ForwardChain)
+}
+
+func TestCleanRemovesTheRulesOfEveryVersion(t *testing.T) {
+	rules, fake := newTestRules(nil)
+	assert.NoError(t, rules.Apply())
+	fake.Append("nat", "PREROUTING", strings.Split(credentialsDnat, " ")...)
+	fake.Append("nat", "OUTPUT", strings.Split(credentialsRedirect, " ")...)
+
+	assert.NoError(t, rules.Clean())
+
+	assert.Empty(t, fake.chains["nat"]["PREROUTING"])
+	assert.Empty(t, fake.chains["nat"]["OUTPUT"])
+	assert.NotContains(t, fake.chains["nat"], PreroutingChain)
+	assert.NotContains(t, fake.chains["nat"], OutputChain)
+}
+
+func TestNewRulesRequiresCIDRsOfTheFamilyOfTheTable(t *testing.T) {
+	block := &firewall.MetadataBlock{Address: "fd00:ec2::254", CIDRs: []string{"172.17.0.0/16"}}
+
+	_, err := NewRules(true, "51679", "fd00::1", "fd00:ec2::23", "", block)
+
+	assert.EqualError(t, err, "IPv4 CIDR 172.17.0.0/16 can't be set in the IPv6 rules")
+}
@@ -0,0 +1,263 @@
+// Package metrics keeps the counters, gauges and histograms of mesos2iam in memory and exposes them in the
+// Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Buckets of the latency histograms, in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var defaultRegistry = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{families: map[string]*family{}}
+}
+
+// Registry holds metric families, exposed by its Handler
+type Registry struct {
+	mutex    sync.Mutex
+	families map[string]*family
+}
+
+func (r *Registry) register(f *family) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.families[f.name]; ok {
+		panic("metric " + f.name + " registered twice")
+	}
+	r.families[f.name] = f
+}
+
+// Handler serves the metrics of the registry in the Prometheus text format
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.Write(w)
+	})
+}
+
+// Write writes the metrics of the registry in the Prometheus text format
+func (r *Registry) Write(w io.Writer) {
+	r.mutex.Lock()
+	names := []string{}
+	for name := range r.families {
+		names = append(names, name)
+	}
+	r.mutex.Unlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		r.mutex.Lock()
+		f := r.families[name]
+		r.mutex.Unlock()
+
+		f.writeTo(w)
+	}
+}
+
+// Handler serves the metrics registered by mesos2iam
+func Handler() http.Handler {
+	return defaultRegistry.Handler()
+}
+
+type family struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	buckets    []float64
+
+	mutex  sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	// histograms only
+	bucketCounts []uint64
+	count        uint64
+}
+
+func newFamily(registry *Registry, kind, name, help string, buckets []float64, labelNames []string) *family {
+	f := &family{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     map[string]*series{},
+	}
+	registry.register(f)
+
+	return f
+}
+
+// with calls update with the series of the label values, creating it when needed
+func (f *family) with(labelValues []string, update func(*series)) {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", f.name, len(f.labelNames), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string{}, labelValues...), bucketCounts: make([]uint64, len(f.buckets))}
+		f.series[key] = s
+	}
+	update(s)
+}
+
+func (f *family) delete(labelValues []string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	delete(f.series, strings.Join(labelValues, "\xff"))
+}
+
+func (f *family) writeTo(w io.Writer) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+
+	keys := []string{}
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := f.series[key]
+		if f.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, formatLabels(f.labelNames, s.labelValues, "", ""), formatValue(s.value))
+			continue
+		}
+
+		for i, bound := range f.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, formatLabels(f.labelNames, s.labelValues, "le", formatValue(bound)), s.bucketCounts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, formatLabels(f.labelNames, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, formatLabels(f.labelNames, s.labelValues, "", ""), formatValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, formatLabels(f.labelNames, s.labelValues, "", ""), s.count)
+	}
+}
+
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	pairs := []string{}
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", name, escapeLabelValue(values[i])))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extraName, extraValue))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(value)
+}
+
+// CounterVec counts events by label values
+type CounterVec struct {
+	family *family
+}
+
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	return NewCounterVecIn(defaultRegistry, name, help, labelNames...)
+}
+
+func NewCounterVecIn(registry *Registry, name, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{newFamily(registry, "counter", name, help, nil, labelNames)}
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.family.with(labelValues, func(s *series) { s.value++ })
+}
+
+// GaugeVec holds the current value of something by label values
+type GaugeVec struct {
+	family *family
+}
+
+func NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	return NewGaugeVecIn(defaultRegistry, name, help, labelNames...)
+}
+
+func NewGaugeVecIn(registry *Registry, name, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{newFamily(registry, "gauge", name, help, nil, labelNames)}
+}
+
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.family.with(labelValues, func(s *series) { s.value = value })
+}
+
+func (g *GaugeVec) Delete(labelValues ...string) {
+	g.family.delete(labelValues)
+}
+
+// HistogramVec counts observations in buckets by label values
+type HistogramVec struct {
+	family *family
+}
+
+func NewHistogramVec(name, help string, labelNames ...string) *HistogramVec {
+	return NewHistogramVecIn(defaultRegistry, name, help, DefaultBuckets, labelNames...)
+}
+
+func NewHistogramVecIn(registry *Registry, name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	return &HistogramVec{newFamily(registry, "histogram", name, help, buckets, labelNames)}
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.family.with(labelValues, func(s *series) {
+		for i, bound := range h.family.buckets {
+			if value <= bound {
+				s.bucketCounts[i]++
+			}
+		}
+		s.count++
+		s.value += value
+	})
+}
+
+// ObserveSince observes the seconds elapsed since start
+func (h *HistogramVec) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegistryWritesTheTextFormat(t *testing.T) {
+	registry := NewRegistry()
+	requests := NewCounterVecIn(registry, "test_requests_total", "Requests", "code", "mode")
+	expiration := NewGaugeVecIn(registry, "test_expiration_seconds", "Expiration", "job_id")
+	duration := NewHistogramVecIn(registry, "test_duration_seconds", "Duration", []float64{0.1, 1}, "result")
+
+	requests.Inc("200", "bridge")
+	requests.Inc("200", "bridge")
+	requests.Inc("404", "host")
+	expiration.Set(1500000000, "my-job")
+	expiration.Set(1600000000, "other\"job")
+	expiration.Delete("my-job")
+	duration.Observe(0.05, "ok")
+	duration.Observe(0.5, "ok")
+
+	buf := &bytes.Buffer{}
+	registry.Write(buf)
+
+	assert.Equal(t, `# HELP test_duration_seconds Duration
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{result="ok",le="0.1"} 1
+test_duration_seconds_bucket{result="ok",le="1"} 2
+test_duration_seconds_bucket{result="ok",le="+Inf"} 2
+test_duration_seconds_sum{result="ok"} 0.55
+test_duration_seconds_count{result="ok"} 2
+# HELP test_expiration_seconds Expiration
+# TYPE test_expiration_seconds gauge
+test_expiration_seconds{job_id="other\"job"} 1.6e+09
+# HELP test_requests_total Requests
+# TYPE test_requests_total counter
+test_requests_total{code="200",mode="bridge"} 2
+test_requests_total{code="404",mode="host"} 1
+`, buf.String())
+}
+
+func TestRegistryHandler(t *testing.T) {
+	registry := NewRegistry()
+	NewCounterVecIn(registry, "test_total", "Test").Inc()
+
+	writer := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(writer, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	assert.Equal(t, 200, writer.Code)
+	assert.Equal(t, "text/plain; version=0.0.4", writer.Header().Get("Content-Type"))
+	assert.Equal(t, "# HELP test_total Test\n# TYPE test_total counter\ntest_total 1\n", writer.Body.String())
+}
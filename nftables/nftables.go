@@ -0,0 +1,285 @@
+// Package nftables redirects the requests of the containers to mesos2iam on hosts running nftables without
+// the iptables compatibility layer, through the nft command.
+package nftables
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/schibsted/mesos2iam/firewall"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+const (
+	// Table owned by mesos2iam, holding all its rules
+	Table           = "mesos2iam"
+	PreroutingChain = "prerouting"
+	OutputChain     = "output"
+	// Chain blocking the EC2 instance metadata service
+	ForwardChain = "forward"
+	// Our chains run before the dstnat ones (priority -100) of Docker and the iptables-nft layer
+	priority = -110
+	// and before the filter ones (priority 0)
+	filterPriority = -10
+)
+
+// runner runs nft with args, feeding it stdin, and returns its output
+type runner func(stdin string, args ...string) (string, error)
+
+func runNft(stdin string, args ...string) (string, error) {
+	cmd := exec.Command("nft", args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("nft %s: %s: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.String(), nil
+}
+
+// Available tells if the nft command is installed
+func Available() bool {
+	_, err := exec.LookPath("nft")
+	return err == nil
+}
+
+// NewRules creates the rules redirecting the requests to credentialsAddress, and to ec2MetadataAddress unless
+// it's empty, to mesos2iam listening on hostIp:appPort, and dropping the traffic of the containers to the
+// EC2 instance metadata service not redirected to mesos2iam unless block is nil. The rules are kept in a
+// table of the ip6 family when ipv6 is true, and all the addresses and CIDRs must be of that family.
+func NewRules(ipv6 bool, appPort, hostIp, credentialsAddress, ec2MetadataAddress string, block *firewall.MetadataBlock) (*Rules, error) {
+	if hostIp == "" {
+		return nil, errors.New("--host-ip must be set")
+	}
+
+	if !Available() {
+		return nil, errors.New("nft command not found")
+	}
+
+	if err := firewall.CheckFamily(ipv6, block, hostIp, credentialsAddress, ec2MetadataAddress); err != nil {
+		return nil, err
+	}
+
+	family := "ip"
+	if ipv6 {
+		family = "ip6"
+	}
+
+	return &Rules{runNft, family, appPort, hostIp, credentialsAddress, ec2MetadataAddress, block}, nil
+}
+
+// Rules are kept in the prerouting and output chains of our own table, of the ip6 family for the rules of
+// the IPv6 addresses, so they can be created and removed atomically without touching the tables of other
+// programs.
+//
+// As with iptables, the requests of containers in bridge mode are sent to mesos2iam from the prerouting
+// chain, the ones of host processes to the credentials address from the output chain. With a MetadataBlock,
+// the forward chain drops the traffic of the containers still addressed to the metadata service.
+type Rules struct {
+	nft runner
+	// ip or ip6, the family of the table and of the addresses
+	family             string
+	appPort            string
+	hostIp             string
+	credentialsAddress string
+	ec2MetadataAddress string
+	block              *firewall.MetadataBlock
+}
+
+var _ firewall.Rules = &Rules{}
+
+// chain is a base chain of our table, attached to the hook of the kind of chain
+type chain struct {
+	name     string
+	kind     string
+	hook     string
+	priority int
+}
+
+type rule struct {
+	chain     string
+	statement string
+	// Tags the rule, so Check can find it in the listing of the table whatever the nft version formats it
+	comment string
+}
+
+func (r *Rules) rules() []rule {
+	rules := []rule{r.dnatRule(r.credentialsAddress)}
+	if r.ec2MetadataAddress != "" {
+		rules = append(rules, r.dnatRule(r.ec2MetadataAddress))
+	}
+
+	rules = append(rules, rule{
+		OutputChain,
+		fmt.Sprintf("%s daddr %s tcp dport 80 redirect to :%s", r.family, r.credentialsAddress, r.appPort),
+		"mesos2iam redirect " + r.credentialsAddress,
+	})
+
+	if r.block != nil {
+		for _, iface := range r.block.Interfaces {
+			rules = append(rules, r.dropRule("iifname "+nftInterface(iface), iface))
+		}
+		for _, cidr := range r.block.CIDRs {
+			rules = append(rules, r.dropRule(r.family+" saddr "+cidr, cidr))
+		}
+	}
+
+	return rules
+}
+
+// dropRule drops the traffic to the metadata service matching match
+func (r *Rules) dropRule(match, source string) rule {
+	return rule{
+		ForwardChain,
+		fmt.Sprintf("%s %s daddr %s drop", match, r.family, r.block.Address),
+		"mesos2iam drop " + source,
+	}
+}
+
+// nftInterface quotes an interface name, turning the iptables wildcard (br-+) into the nftables one (br-*)
+func nftInterface(iface string) string {
+	return "\"" + strings.Replace(iface, "+", "*", -1) + "\""
+}
+
+// dnatRule sends the requests of containers in bridge mode to address to mesos2iam
+func (r *Rules) dnatRule(address string) rule {
+	return rule{
+		PreroutingChain,
+		fmt.Sprintf("%s daddr %s tcp dport 80 dnat to %s", r.family, address, net.JoinHostPort(r.hostIp, r.appPort)),
+		"mesos2iam dnat " + address,
+	}
+}
+
+// script declares our table, deletes it and creates it again with our rules. nft applies the whole script
+// in one transaction, so running it again replaces the table without any window without rules.
+func (r *Rules) script() string {
+	script := fmt.Sprintf("table %s %s\ndelete table %s %s\ntable %s %s {\n", r.family, Table, r.family, Table, r.family, Table)
+	chains := []chain{{PreroutingChain, "nat", "prerouting", priority}, {OutputChain, "nat", "output", priority}}
+	if r.block != nil {
+		chains = append(chains, chain{ForwardChain, "filter", "forward", filterPriority})
+	}
+
+	for _, base := range chains {
+		script += fmt.Sprintf("\tchain %s {\n\t\ttype %s hook %s priority %d; policy accept;\n", base.name, base.kind, base.hook, base.priority)
+		for _, rule := range r.rules() {
+			if rule.chain == base.name {
+				script += fmt.Sprintf("\t\t%s comment \"%s\"\n", rule.statement, rule.comment)
+			}
+		}
+		script += "\t}\n"
+	}
+
+	return script + "}\n"
+}
+
+// Apply creates our table with its rules, replacing the one left by a previous run
+func (r *Rules) Apply() error {
+	if _, err := r.nft(r.script(), "-f", "-"); err != nil {
+		return err
+	}
+
+	log.Infof("Rules of %s %s table set", r.family, Table)
+	return nil
+}
+
+// Reconcile creates our table again when it, or any of its rules, was removed, e.g. by a firewall flushing
+// the ruleset. It returns the number of chains repaired.
+func (r *Rules) Reconcile() (int, error) {
+	broken, err := r.brokenChains()
+	if err != nil || len(broken) == 0 {
+		return 0, err
+	}
+
+	if _, err := r.nft(r.script(), "-f", "-"); err != nil {
+		return 0, err
+	}
+
+	for _, chain := range broken {
+		log.Warnf("Rules of %s chain of %s %s table restored", chain, r.family, Table)
+		firewall.CountRepair("nftables", chain)
+	}
+
+	return len(broken), nil
+}
+
+// Check fails when any rule is missing. Rules are found by their comment tags only: a rule edited in place
+// keeping its comment, or moved within our table, isn't detected, as nftables reformats the statements it
+// lists. Our table runs before the ones of other programs whatever their rules, so there are no jumps to
+// misorder.
+func (r *Rules) Check() error {
+	broken, err := r.brokenChains()
+	if err != nil {
+		return err
+	}
+
+	if len(broken) > 0 {
+		return fmt.Errorf("Rules missing in %s chains of %s %s table", strings.Join(broken, ", "), r.family, Table)
+	}
+
+	return nil
+}
+
+// brokenChains returns the chains missing the comment tag of any of our rules
+func (r *Rules) brokenChains() ([]string, error) {
+	exists, err := r.tableExists()
+	if err != nil {
+		return nil, err
+	}
+
+	listing := ""
+	if exists {
+		if listing, err = r.nft("", "list", "table", r.family, Table); err != nil {
+			return nil, err
+		}
+	}
+
+	broken := []string{}
+	for _, rule := range r.rules() {
+		if strings.Contains(listing, "\""+rule.comment+"\"") {
+			continue
+		}
+
+		if len(broken) == 0 || broken[len(broken)-1] != rule.chain {
+			broken = append(broken, rule.chain)
+		}
+	}
+
+	return broken, nil
+}
+
+// Clean removes the rules left by any version of mesos2iam, which all live in our table
+func (r *Rules) Clean() error {
+	return r.Delete()
+}
+
+// Delete removes our table with its rules
+func (r *Rules) Delete() error {
+	exists, err := r.tableExists()
+	if err != nil || !exists {
+		return err
+	}
+
+	_, err = r.nft("", "delete", "table", r.family, Table)
+	return err
+}
+
+func (r *Rules) tableExists() (bool, error) {
+	tables, err := r.nft("", "list", "tables", r.family)
+	if err != nil {
+		return false, err
+	}
+
+	for _, line := range strings.Split(tables, "\n") {
+		if strings.TrimSpace(line) == "table "+r.family+" "+Table {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,129 @@
+package nftables
+
+import (
+	"github.com/schibsted/mesos2iam/firewall"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+// fakeNft keeps the script of the table it was last given, "listing" it back with the comments of the rules
+type fakeNft struct {
+	table string
+	calls []string
+}
+
+func (f *fakeNft) run(stdin string, args ...string) (string, error) {
+	f.calls = append(f.calls, strings.Join(args, " "))
+
+	switch strings.Join(args, " ") {
+	case "-f -":
+		f.table = stdin
+	case "list tables ip":
+		if f.table == "" {
+			return "", nil
+		}
+		return "table ip mesos2iam\n", nil
+	case "list table ip mesos2iam":
+		return f.table, nil
+	case "delete table ip mesos2iam":
+		f.table = ""
+	}
+
+	return "", nil
+}
+
+func newTestRules(ec2MetadataAddress string) (*Rules, *fakeNft) {
+	fake := &fakeNft{}
+	return &Rules{fake.run, "ip", "51679", "10.0.0.1", "169.254.170.2", ec2MetadataAddress, nil}, fake
+}
+
+func TestApplyReplacesTheTableAtomically(t *testing.T) {
+	rules, fake := newTestRules("169.254.169.254")
+
+	assert.NoError(t, rules.Apply())
+
+	assert.Equal(t, `table ip mesos2iam
+delete table ip mesos2iam
+table ip mesos2iam {
+	chain prerouting {
+		type nat hook prerouting priority -110; policy accept;
+		ip daddr 169.254.170.2 tcp dport 80 dnat to 10.0.0.1:51679 comment "mesos2iam dnat 169.254.170.2"
+		ip daddr 169.254.169.254 tcp dport 80 dnat to 10.0.0.1:51679 comment "mesos2iam dnat 169.254.169.254"
+	}
+	chain output {
+		type nat hook output priority -110; policy accept;
+		ip daddr 169.254.170.2 tcp dport 80 redirect to :51679 comment "mesos2iam redirect 169.254.170.2"
+	}
+}
+`, fake.table)
+	assert.NoError(t, rules.Check())
+}
+
+func TestApplyCreatesAnIPv6TableForIPv6Addresses(t *testing.T) {
+	fake := &fakeNft{}
+	rules := &Rules{fake.run, "ip6", "51679", "fd00::1", "fd00:ec2::23", "", nil}
+
+	assert.NoError(t, rules.Apply())
+
+	assert.Contains(t, fake.table, "table ip6 mesos2iam {\n")
+	assert.Contains(t, fake.table, `ip6 daddr fd00:ec2::23 tcp dport 80 dnat to [fd00::1]:51679`)
+	assert.Contains(t, fake.table, `ip6 daddr fd00:ec2::23 tcp dport 80 redirect to :51679`)
+}
+
+func TestApplyDropsTheContainerTrafficToTheMetadataService(t *testing.T) {
+	rules, fake := newTestRules("169.254.169.254")
+	rules.block = &firewall.MetadataBlock{
+		Address:    "169.254.169.254",
+		Interfaces: []string{"docker0", "br-+"},
+		CIDRs:      []string{"10.1.0.0/16"},
+	}
+
+	assert.NoError(t, rules.Apply())
+
+	assert.Contains(t, fake.table, `	chain forward {
+		type filter hook forward priority -10; policy accept;
+		iifname "docker0" ip daddr 169.254.169.254 drop comment "mesos2iam drop docker0"
+		iifname "br-*" ip daddr 169.254.169.254 drop comment "mesos2iam drop br-+"
+		ip saddr 10.1.0.0/16 ip daddr 169.254.169.254 drop comment "mesos2iam drop 10.1.0.0/16"
+	}
+`)
+	assert.NoError(t, rules.Check())
+
+	fake.table = strings.Replace(fake.table, `"mesos2iam drop docker0"`, "", 1)
+	assert.EqualError(t, rules.Check(), "Rules missing in forward chains of ip mesos2iam table")
+}
+
+func TestReconcileRestoresTheMissingRules(t *testing.T) {
+	rules, fake := newTestRules("")
+	assert.NoError(t, rules.Apply())
+
+	repaired, err := rules.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, repaired)
+
+	fake.table = strings.Replace(fake.table, `comment "mesos2iam redirect 169.254.170.2"`, "", 1)
+	assert.EqualError(t, rules.Check(), "Rules missing in output chains of ip mesos2iam table")
+
+	repaired, err = rules.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, repaired)
+	assert.NoError(t, rules.Check())
+
+	fake.table = ""
+	repaired, err = rules.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, repaired)
+}
+
+func TestDeleteOnlyRemovesAnExistingTable(t *testing.T) {
+	rules, fake := newTestRules("")
+
+	assert.NoError(t, rules.Delete())
+	assert.Equal(t, []string{"list tables ip"}, fake.calls)
+
+	assert.NoError(t, rules.Apply())
+	assert.NoError(t, rules.Delete())
+	assert.Equal(t, "", fake.table)
+	assert.EqualError(t, rules.Check(), "Rules missing in prerouting, output chains of ip mesos2iam table")
+}
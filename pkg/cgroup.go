@@ -0,0 +1,47 @@
+package pkg
+
+import (
+	"bufio"
+	"github.com/go-errors/errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Matches the Docker container ID in the cgroup paths created by the cgroupfs driver (/docker/<id>) and the
+// systemd one (/system.slice/docker-<id>.scope)
+var dockerCgroupRegexp = regexp.MustCompile(`docker[-/]([0-9a-f]{64})(?:\.scope)?(?:/|$)`)
+
+// readCgroupPaths returns the cgroup paths of a process for every hierarchy found in /proc/<pid>/cgroup,
+// both the cgroup v1 ones (4:memory:/docker/<id>) and the cgroup v2 unified one (0::/system.slice/...).
+func readCgroupPaths(procRoot string, pid int32) ([]string, error) {
+	file, err := os.Open(filepath.Join(procRoot, strconv.Itoa(int(pid)), "cgroup"))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	paths := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) == 3 {
+			paths = append(paths, fields[2])
+		}
+	}
+
+	return paths, scanner.Err()
+}
+
+// dockerContainerIdFromCgroups returns the ID of the Docker container a process belongs to
+func dockerContainerIdFromCgroups(paths []string) (string, error) {
+	for _, path := range paths {
+		if match := dockerCgroupRegexp.FindStringSubmatch(path); match != nil {
+			return match[1], nil
+		}
+	}
+
+	return "", errors.Errorf("Process does not belong to a Docker container")
+}
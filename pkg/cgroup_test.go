@@ -0,0 +1,59 @@
+package pkg
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testContainerId = "8f2a0b5c1d9e4f3a7b6c5d4e3f2a1b0c9d8e7f6a5b4c3d2e1f0a9b8c7d6e5f4a"
+
+func TestDockerContainerIdFromCgroupfsDriver(t *testing.T) {
+	cgroups := "11:memory:/docker/" + testContainerId + "\n" +
+		"1:name=systemd:/docker/" + testContainerId + "\n"
+
+	assertDockerContainerIdFromCgroup(t, cgroups)
+}
+
+func TestDockerContainerIdFromSystemdDriver(t *testing.T) {
+	cgroups := "11:memory:/system.slice/docker-" + testContainerId + ".scope\n" +
+		"1:name=systemd:/system.slice/docker-" + testContainerId + ".scope\n"
+
+	assertDockerContainerIdFromCgroup(t, cgroups)
+}
+
+func TestDockerContainerIdFromUnifiedHierarchy(t *testing.T) {
+	assertDockerContainerIdFromCgroup(t, "0::/system.slice/docker-"+testContainerId+".scope\n")
+}
+
+func TestDockerContainerIdFromNestedCgroup(t *testing.T) {
+	assertDockerContainerIdFromCgroup(t, "4:cpu,cpuacct:/mesos/2b0e1f2a/docker/"+testContainerId+"/supervisor\n")
+}
+
+func TestDockerContainerIdFromHostProcessFails(t *testing.T) {
+	paths := []string{"/user.slice/user-1000.slice/session-2.scope", "/init.scope"}
+
+	_, err := dockerContainerIdFromCgroups(paths)
+
+	assert.Error(t, err)
+}
+
+func assertDockerContainerIdFromCgroup(t *testing.T, cgroups string) {
+	procRoot, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(procRoot)
+
+	os.MkdirAll(filepath.Join(procRoot, "1234"), 0755)
+	ioutil.WriteFile(filepath.Join(procRoot, "1234", "cgroup"), []byte(cgroups), 0644)
+
+	paths, err := readCgroupPaths(procRoot, 1234)
+	assert.NoError(t, err)
+
+	id, err := dockerContainerIdFromCgroups(paths)
+	assert.NoError(t, err)
+	assert.Equal(t, testContainerId, id)
+}
@@ -0,0 +1,330 @@
+package pkg
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/go-errors/errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Minimum time between two full resyncs triggered by lookups of unknown containers
+	minResyncInterval = time.Second
+	// Maximum time a lookup of an unknown container waits for the resync it triggered
+	lookupResyncTimeout = 5 * time.Second
+)
+
+// DockerClient is the part of the Docker API used to index containers
+type DockerClient interface {
+	ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error)
+	InspectContainer(id string) (*docker.Container, error)
+	AddEventListener(listener chan<- *docker.APIEvents) error
+	RemoveEventListener(listener chan *docker.APIEvents) error
+}
+
+// JobIdRepository is implemented by the container repositories that already know the job id of the
+// containers they return
+type JobIdRepository interface {
+	FindJobIdOfContainer(containerId string) (string, bool)
+}
+
+func NewDockerContainerIndex(client DockerClient, jobIds *JobIdResolver, allowedNetworks []string) *DockerContainerIndex {
+	return &DockerContainerIndex{
+		docker:          client,
+		resolver:        jobIds,
+		procRoot:        "/proc",
+		allowedNetworks: allowedNetworks,
+		containers:      map[string]*docker.Container{},
+		byIp:            map[string]string{},
+		byPid:           map[int32]string{},
+		jobIds:          map[string]string{},
+		resyncs:         make(chan chan error),
+	}
+}
+
+// DockerContainerIndex answers container lookups from memory. It is kept up to date by the Docker events
+// stream and resynced periodically with the full list of containers. Once started, the index is only
+// updated by the goroutine of Start, so a resync can't overwrite the changes of the events that follow it.
+// implements ContainerRepository and JobIdRepository
+type DockerContainerIndex struct {
+	docker          DockerClient
+	resolver        *JobIdResolver
+	procRoot        string
+	allowedNetworks []string
+
+	mutex      sync.RWMutex
+	containers map[string]*docker.Container
+	byIp       map[string]string
+	byPid      map[int32]string
+	jobIds     map[string]string
+	lastSync   time.Time
+
+	// resyncs receives the resyncs requested by lookups of unknown containers, done with the error sent back
+	resyncs chan chan error
+}
+
+// Start indexes the running containers and keeps the index updated until stop is closed.
+func (index *DockerContainerIndex) Start(resyncInterval time.Duration, stop <-chan struct{}) error {
+	events := make(chan *docker.APIEvents, 100)
+	if err := index.docker.AddEventListener(events); err != nil {
+		countDockerError("events", err)
+		return err
+	}
+
+	if err := index.Resync(); err != nil {
+		index.docker.RemoveEventListener(events)
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(resyncInterval)
+		defer ticker.Stop()
+		defer index.docker.RemoveEventListener(events)
+
+		for {
+			select {
+			case event := <-events:
+				index.HandleEvent(event)
+			case <-ticker.C:
+				if err := index.Resync(); err != nil {
+					log.Error("Couldn't resync Docker containers: ", err)
+				}
+			case done := <-index.resyncs:
+				done <- index.resyncIfStale()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Resync rebuilds the index from the list of running containers. Once the index is started, it must only be
+// called by its goroutine.
+func (index *DockerContainerIndex) Resync() error {
+	containers, err := index.docker.ListContainers(docker.ListContainersOptions{})
+	countDockerError("list", err)
+	if err != nil {
+		return err
+	}
+
+	inspected := []*docker.Container{}
+	for _, container := range containers {
+		containerInfo, err := index.docker.InspectContainer(container.ID)
+		countDockerError("inspect", err)
+		if err != nil {
+			log.Warnf("Couldn't inspect container %s: %s", container.ID, err)
+			continue
+		}
+
+		inspected = append(inspected, containerInfo)
+	}
+
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	index.containers = map[string]*docker.Container{}
+	index.byIp = map[string]string{}
+	index.byPid = map[int32]string{}
+	index.jobIds = map[string]string{}
+	for _, container := range inspected {
+		index.add(container)
+	}
+	index.lastSync = time.Now()
+
+	log.Debugf("Indexed %d Docker containers", len(index.containers))
+	return nil
+}
+
+// HandleEvent updates the index with a Docker event. Once the index is started, it must only be called by its
+// goroutine.
+func (index *DockerContainerIndex) HandleEvent(event *docker.APIEvents) {
+	if event == nil {
+		return
+	}
+
+	switch eventType, action, containerId := parseEvent(event); {
+	case eventType == "container" && action == "start":
+		index.reindex(containerId)
+	case eventType == "container" && (action == "die" || action == "destroy"):
+		index.mutex.Lock()
+		index.remove(containerId)
+		index.mutex.Unlock()
+	case eventType == "network" && (action == "connect" || action == "disconnect"):
+		index.reindex(containerId)
+	}
+}
+
+// parseEvent reads the events of both the current API and the one before 1.22
+func parseEvent(event *docker.APIEvents) (string, string, string) {
+	if event.Type == "" {
+		return "container", event.Status, event.ID
+	}
+
+	if event.Type == "network" {
+		return event.Type, event.Action, event.Actor.Attributes["container"]
+	}
+
+	return event.Type, event.Action, event.Actor.ID
+}
+
+func (index *DockerContainerIndex) reindex(containerId string) {
+	if containerId == "" {
+		return
+	}
+
+	container, err := index.docker.InspectContainer(containerId)
+	countDockerError("inspect", err)
+
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	index.remove(containerId)
+	if err != nil {
+		log.Warnf("Couldn't inspect container %s: %s", containerId, err)
+		return
+	}
+
+	if container.State.Running {
+		index.add(container)
+	}
+}
+
+// add must be called holding the lock
+func (index *DockerContainerIndex) add(container *docker.Container) {
+	index.containers[container.ID] = container
+
+	if container.State.Pid != 0 {
+		index.byPid[int32(container.State.Pid)] = container.ID
+	}
+
+	for _, ip := range containerIps(container, index.allowedNetworks) {
+		index.byIp[normalizeIp(ip)] = container.ID
+	}
+
+	if jobId, err := index.resolver.Resolve(container); err == nil {
+		index.jobIds[container.ID] = jobId
+	}
+}
+
+// remove must be called holding the lock
+func (index *DockerContainerIndex) remove(containerId string) {
+	delete(index.containers, containerId)
+	delete(index.jobIds, containerId)
+
+	for ip, id := range index.byIp {
+		if id == containerId {
+			delete(index.byIp, ip)
+		}
+	}
+
+	for pid, id := range index.byPid {
+		if id == containerId {
+			delete(index.byPid, pid)
+		}
+	}
+}
+
+func (index *DockerContainerIndex) FindContainerUsingIp(ip string) (*docker.Container, error) {
+	container, ok := index.lookup(func() string { return index.byIp[normalizeIp(ip)] })
+	if !ok {
+		return nil, errors.Errorf("Container with ip %s does not exist", ip)
+	}
+
+	log.Debug("Found IP: ", ip)
+	return container, nil
+}
+
+func (index *DockerContainerIndex) FindContainerUsingCommandPID(pid int32) (*docker.Container, error) {
+	if paths, err := readCgroupPaths(index.procRoot, pid); err == nil {
+		if containerId, err := dockerContainerIdFromCgroups(paths); err == nil {
+			if container, ok := index.lookup(func() string { return containerId }); ok {
+				return container, nil
+			}
+		}
+	}
+
+	return findByAncestor(pid, func(ancestor int32) (*docker.Container, bool) {
+		index.mutex.RLock()
+		defer index.mutex.RUnlock()
+
+		container, ok := index.containers[index.byPid[ancestor]]
+		return container, ok
+	})
+}
+
+func (index *DockerContainerIndex) FindJobIdOfContainer(containerId string) (string, bool) {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	jobId, ok := index.jobIds[containerId]
+	return jobId, ok
+}
+
+// normalizeIp returns the canonical representation of an IP address, used as key of the index
+func normalizeIp(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		return parsed.String()
+	}
+
+	return ip
+}
+
+// lookup finds a container by the id returned by find, resyncing the index once when it's not found in
+// case the event announcing it hasn't been processed yet
+func (index *DockerContainerIndex) lookup(find func() string) (*docker.Container, bool) {
+	index.mutex.RLock()
+	container, ok := index.containers[find()]
+	stale := time.Since(index.lastSync) > minResyncInterval
+	index.mutex.RUnlock()
+
+	if ok || !stale {
+		return container, ok
+	}
+
+	if err := index.requestResync(); err != nil {
+		log.Error("Couldn't resync Docker containers: ", err)
+		return nil, false
+	}
+
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	container, ok = index.containers[find()]
+	return container, ok
+}
+
+// requestResync has the goroutine of the index resync it, unless it was resynced less than minResyncInterval
+// ago, and waits for it
+func (index *DockerContainerIndex) requestResync() error {
+	timeout := time.After(lookupResyncTimeout)
+	done := make(chan error, 1)
+
+	select {
+	case index.resyncs <- done:
+	case <-timeout:
+		return errors.New("Timed out requesting a resync")
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-timeout:
+		return errors.New("Timed out waiting for the resync")
+	}
+}
+
+func (index *DockerContainerIndex) resyncIfStale() error {
+	index.mutex.RLock()
+	stale := time.Since(index.lastSync) > minResyncInterval
+	index.mutex.RUnlock()
+
+	if !stale {
+		return nil
+	}
+
+	return index.Resync()
+}
@@ -0,0 +1,172 @@
+package pkg
+
+import (
+	"github.com/fsouza/go-dockerclient"
+	"github.com/go-errors/errors"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeDockerClient struct {
+	mutex      sync.Mutex
+	containers map[string]*docker.Container
+	inspects   int
+}
+
+func newFakeDockerClient(containers ...*docker.Container) *fakeDockerClient {
+	client := &fakeDockerClient{containers: map[string]*docker.Container{}}
+	for _, container := range containers {
+		client.containers[container.ID] = container
+	}
+
+	return client
+}
+
+func (c *fakeDockerClient) ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	containers := []docker.APIContainers{}
+	for id := range c.containers {
+		containers = append(containers, docker.APIContainers{ID: id})
+	}
+
+	return containers, nil
+}
+
+func (c *fakeDockerClient) InspectContainer(id string) (*docker.Container, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.inspects++
+	container, ok := c.containers[id]
+	if !ok {
+		return nil, errors.Errorf("No such container: %s", id)
+	}
+
+	return container, nil
+}
+
+func (c *fakeDockerClient) AddEventListener(listener chan<- *docker.APIEvents) error {
+	return nil
+}
+
+func (c *fakeDockerClient) RemoveEventListener(listener chan *docker.APIEvents) error {
+	return nil
+}
+
+func newIndexedContainer(id, ip string, pid int) *docker.Container {
+	return &docker.Container{
+		ID: id,
+		Config: &docker.Config{
+			Env: []string{"TARDIS_SCHID=4ea13548-caa8-48dc-af69-58a651d9fa3b"},
+		},
+		State:           docker.State{Running: true, Pid: pid},
+		NetworkSettings: &docker.NetworkSettings{IPAddress: ip},
+	}
+}
+
+func TestDockerContainerIndexAnswersFromMemory(t *testing.T) {
+	client := newFakeDockerClient(newIndexedContainer("first", "172.17.0.2", 100), newIndexedContainer("second", "172.17.0.3", 200))
+	index := NewDockerContainerIndex(client, NewJobIdResolver(NewUUIDv4JobIdValidator(), NewEnvJobIdSource("TARDIS_SCHID=")), nil)
+	assert.NoError(t, index.Resync())
+	inspects := client.inspects
+
+	container, err := index.FindContainerUsingIp("172.17.0.3")
+	assert.NoError(t, err)
+	assert.Equal(t, "second", container.ID)
+
+	container, err = index.FindContainerUsingCommandPID(100)
+	assert.NoError(t, err)
+	assert.Equal(t, "first", container.ID)
+
+	jobId, ok := index.FindJobIdOfContainer("first")
+	assert.True(t, ok)
+	assert.Equal(t, "4ea13548-caa8-48dc-af69-58a651d9fa3b", jobId)
+
+	assert.Equal(t, inspects, client.inspects)
+}
+
+func TestDockerContainerIndexFollowsEvents(t *testing.T) {
+	client := newFakeDockerClient()
+	index := NewDockerContainerIndex(client, NewJobIdResolver(NewUUIDv4JobIdValidator(), NewEnvJobIdSource("TARDIS_SCHID=")), nil)
+	assert.NoError(t, index.Resync())
+
+	client.containers["new"] = newIndexedContainer("new", "172.17.0.4", 300)
+	index.HandleEvent(&docker.APIEvents{Type: "container", Action: "start", Actor: docker.APIActor{ID: "new"}})
+
+	container, err := index.FindContainerUsingIp("172.17.0.4")
+	assert.NoError(t, err)
+	assert.Equal(t, "new", container.ID)
+
+	client.containers["new"].NetworkSettings.IPAddress = "172.17.0.5"
+	index.HandleEvent(&docker.APIEvents{Type: "network", Action: "connect", Actor: docker.APIActor{
+		Attributes: map[string]string{"container": "new"},
+	}})
+
+	container, err = index.FindContainerUsingIp("172.17.0.5")
+	assert.NoError(t, err)
+	assert.Equal(t, "new", container.ID)
+
+	delete(client.containers, "new")
+	index.HandleEvent(&docker.APIEvents{Status: "die", ID: "new"})
+
+	_, ok := index.FindJobIdOfContainer("new")
+	assert.False(t, ok)
+}
+
+func TestDockerContainerIndexResyncsUnknownContainersInItsGoroutine(t *testing.T) {
+	client := newFakeDockerClient()
+	index := NewDockerContainerIndex(client, NewJobIdResolver(NewUUIDv4JobIdValidator(), NewEnvJobIdSource("TARDIS_SCHID=")), nil)
+	stop := make(chan struct{})
+	defer close(stop)
+	assert.NoError(t, index.Start(time.Hour, stop))
+
+	client.mutex.Lock()
+	client.containers["missed"] = newIndexedContainer("missed", "172.17.0.6", 600)
+	client.mutex.Unlock()
+
+	// Too soon after the last resync
+	_, err := index.FindContainerUsingIp("172.17.0.6")
+	assert.Error(t, err)
+
+	index.mutex.Lock()
+	index.lastSync = time.Time{}
+	index.mutex.Unlock()
+
+	container, err := index.FindContainerUsingIp("172.17.0.6")
+	assert.NoError(t, err)
+	assert.Equal(t, "missed", container.ID)
+}
+
+func TestDockerContainerIndexFindsContainersInUserDefinedNetworks(t *testing.T) {
+	container := newIndexedContainer("overlay", "", 400)
+	container.NetworkSettings.Networks = map[string]docker.ContainerNetwork{
+		"tasks":    {IPAddress: "10.0.1.7", GlobalIPv6Address: "fd00:1::7"},
+		"frontend": {IPAddress: "10.0.2.7"},
+	}
+	index := NewDockerContainerIndex(newFakeDockerClient(container), NewJobIdResolver(NewUUIDv4JobIdValidator(), NewEnvJobIdSource("TARDIS_SCHID=")), []string{"tasks"})
+	assert.NoError(t, index.Resync())
+
+	found, err := index.FindContainerUsingIp("10.0.1.7")
+	assert.NoError(t, err)
+	assert.Equal(t, "overlay", found.ID)
+
+	found, err = index.FindContainerUsingIp("fd00:1:0::7")
+	assert.NoError(t, err)
+	assert.Equal(t, "overlay", found.ID)
+
+	_, err = index.FindContainerUsingIp("10.0.2.7")
+	assert.Error(t, err, "Containers can't request credentials from networks not allowed")
+}
+
+func TestContainerIpsOfDefaultBridgeNetwork(t *testing.T) {
+	container := newIndexedContainer("bridged", "172.17.0.2", 500)
+	container.NetworkSettings.GlobalIPv6Address = "2001:db8::2"
+
+	assert.Equal(t, []string{"172.17.0.2", "2001:db8::2"}, containerIps(container, nil))
+	assert.Equal(t, []string{"172.17.0.2", "2001:db8::2"}, containerIps(container, []string{"bridge"}))
+	assert.Empty(t, containerIps(container, []string{"tasks"}))
+}
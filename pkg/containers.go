@@ -5,7 +5,7 @@ import (
 	"github.com/fsouza/go-dockerclient"
 	"github.com/go-errors/errors"
 	"github.com/shirou/gopsutil/process"
-	"regexp"
+	"net"
 	"strings"
 )
 
@@ -14,60 +14,105 @@ type ContainerRepository interface {
 	FindContainerUsingIp(ip string) (*docker.Container, error)
 }
 
-func NewContainerRepository(client *docker.Client, mesos2IamPrefix string) *DockerContainerRepository {
+// NewContainerRepository creates a repository of Docker containers. Only the addresses of the containers in
+// allowedNetworks are matched, or in any network when it's empty.
+func NewContainerRepository(client *docker.Client, allowedNetworks []string) *DockerContainerRepository {
 	return &DockerContainerRepository{
 		docker:          client,
-		mesos2IamPrefix: mesos2IamPrefix,
+		procRoot:        "/proc",
+		allowedNetworks: allowedNetworks,
 	}
 }
 
 // implements ContainerRepository
 type DockerContainerRepository struct {
 	docker          *docker.Client
-	mesos2IamPrefix string
+	procRoot        string
+	allowedNetworks []string
 }
 
-func (repository *DockerContainerRepository) findByContainerPID(pid int32) (*docker.Container, error) {
+// findByCgroup finds the container of any process inside it through the Docker container ID in its cgroups
+func (repository *DockerContainerRepository) findByCgroup(pid int32) (*docker.Container, error) {
+	paths, err := readCgroupPaths(repository.procRoot, pid)
+	if err != nil {
+		return nil, err
+	}
+
+	containerId, err := dockerContainerIdFromCgroups(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("Process %d belongs to container %s", pid, containerId)
+
+	container, err := repository.docker.InspectContainer(containerId)
+	countDockerError("inspect", err)
+
+	return container, err
+}
+
+// findByAncestorPID looks for a container whose init process is the process or any of its ancestors
+func (repository *DockerContainerRepository) findByAncestorPID(pid int32) (*docker.Container, error) {
 	containers, err := repository.docker.ListContainers(docker.ListContainersOptions{})
+	countDockerError("list", err)
 	if err != nil {
 		log.Error(err.Error())
 		return nil, err
 	}
 
+	containersByPid := map[int32]*docker.Container{}
 	for _, container := range containers {
 		containerInfo, err := repository.docker.InspectContainer(container.ID)
+		countDockerError("inspect", err)
 		if err != nil {
 			log.Error(err.Error())
 			return nil, err
 		}
 
-		if pid == int32(containerInfo.State.Pid) {
-			log.Debug("Found PID: ", pid)
-
-			return containerInfo, nil
-		}
+		containersByPid[int32(containerInfo.State.Pid)] = containerInfo
 	}
 
-	return nil, errors.Errorf("Container that contains process %d does not exist", pid)
+	return findByAncestor(pid, func(ancestor int32) (*docker.Container, bool) {
+		container, ok := containersByPid[ancestor]
+		return container, ok
+	})
 }
 
-func (repository *DockerContainerRepository) FindContainerUsingCommandPID(pid int32) (*docker.Container, error) {
-	proc, err := process.NewProcess(int32(pid))
+// findByAncestor walks up the process tree until lookup finds a container whose init is the process or
+// one of its ancestors
+func findByAncestor(pid int32, lookup func(int32) (*docker.Container, bool)) (*docker.Container, error) {
+	for ancestor := pid; ancestor > 1; {
+		if container, ok := lookup(ancestor); ok {
+			log.Debug("Found PID: ", ancestor)
 
-	if err != nil {
-		log.Error(err.Error())
-		return nil, err
+			return container, nil
+		}
+
+		proc, err := process.NewProcess(ancestor)
+		if err != nil {
+			return nil, err
+		}
+
+		parent, err := proc.Parent()
+		if err != nil {
+			return nil, err
+		}
+
+		ancestor = parent.Pid
 	}
 
-	parent, err := proc.Parent()
+	return nil, errors.Errorf("Container that contains process %d does not exist", pid)
+}
 
-	if err != nil {
-		log.Error(err.Error())
-		return nil, err
+func (repository *DockerContainerRepository) FindContainerUsingCommandPID(pid int32) (*docker.Container, error) {
+	container, err := repository.findByCgroup(pid)
+	if err == nil {
+		return container, nil
 	}
 
-	container, err := repository.findByContainerPID(parent.Pid)
+	log.Debugf("Couldn't find the container of process %d by its cgroups: %s", pid, err)
 
+	container, err = repository.findByAncestorPID(pid)
 	if err != nil {
 		log.Error(err)
 		return nil, errors.Errorf("Container that contains process %d does not exist", pid)
@@ -78,6 +123,7 @@ func (repository *DockerContainerRepository) FindContainerUsingCommandPID(pid in
 
 func (repository *DockerContainerRepository) FindContainerUsingIp(ip string) (*docker.Container, error) {
 	containers, err := repository.docker.ListContainers(docker.ListContainersOptions{})
+	countDockerError("list", err)
 
 	if err != nil {
 		log.Error(err.Error())
@@ -86,22 +132,117 @@ func (repository *DockerContainerRepository) FindContainerUsingIp(ip string) (*d
 
 	for _, container := range containers {
 		containerInfo, err := repository.docker.InspectContainer(container.ID)
+		countDockerError("inspect", err)
 
 		if err != nil {
 			log.Error(err.Error())
 			return nil, err
 		}
 
-		if ip == containerInfo.NetworkSettings.IPAddress {
-			log.Debug("Found IP: ", ip)
+		for _, containerIp := range containerIps(containerInfo, repository.allowedNetworks) {
+			if sameIp(ip, containerIp) {
+				log.Debug("Found IP: ", ip)
 
-			return containerInfo, nil
+				return containerInfo, nil
+			}
 		}
 	}
 
 	return nil, errors.Errorf("Container with ip %s does not exist", ip)
 }
 
+// containerIps returns the IPv4 and IPv6 addresses of the container in every network allowed to request
+// credentials: the default bridge network ("bridge") and the user-defined ones.
+func containerIps(container *docker.Container, allowedNetworks []string) []string {
+	ips := []string{}
+	if container.NetworkSettings == nil {
+		return ips
+	}
+
+	settings := container.NetworkSettings
+	if isNetworkAllowed("bridge", allowedNetworks) {
+		ips = appendIps(ips, settings.IPAddress, settings.GlobalIPv6Address)
+	}
+
+	for name, network := range settings.Networks {
+		if isNetworkAllowed(name, allowedNetworks) {
+			ips = appendIps(ips, network.IPAddress, network.GlobalIPv6Address)
+		}
+	}
+
+	return ips
+}
+
+func appendIps(ips []string, candidates ...string) []string {
+	for _, ip := range candidates {
+		if ip != "" {
+			ips = append(ips, ip)
+		}
+	}
+
+	return ips
+}
+
+func isNetworkAllowed(name string, allowedNetworks []string) bool {
+	if len(allowedNetworks) == 0 {
+		return true
+	}
+
+	for _, allowed := range allowedNetworks {
+		if name == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sameIp compares IP addresses regardless of their representation, e.g. fd00::1 and fd00:0::1
+func sameIp(a, b string) bool {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	if ipA == nil || ipB == nil {
+		return a == b
+	}
+
+	return ipA.Equal(ipB)
+}
+
+// NewChainContainerRepository returns a repository looking for containers in every repository, in order.
+func NewChainContainerRepository(repositories ...ContainerRepository) *ChainContainerRepository {
+	return &ChainContainerRepository{repositories}
+}
+
+// implements ContainerRepository
+type ChainContainerRepository struct {
+	repositories []ContainerRepository
+}
+
+func (repository *ChainContainerRepository) FindContainerUsingCommandPID(pid int32) (*docker.Container, error) {
+	return repository.find(func(r ContainerRepository) (*docker.Container, error) {
+		return r.FindContainerUsingCommandPID(pid)
+	})
+}
+
+func (repository *ChainContainerRepository) FindContainerUsingIp(ip string) (*docker.Container, error) {
+	return repository.find(func(r ContainerRepository) (*docker.Container, error) {
+		return r.FindContainerUsingIp(ip)
+	})
+}
+
+func (repository *ChainContainerRepository) find(find func(ContainerRepository) (*docker.Container, error)) (*docker.Container, error) {
+	messages := []string{}
+	for _, r := range repository.repositories {
+		container, err := find(r)
+		if err == nil {
+			return container, nil
+		}
+
+		messages = append(messages, err.Error())
+	}
+
+	return nil, errors.New(strings.Join(messages, "; "))
+}
+
 type ContainerFinder interface {
 	Find() (*docker.Container, error)
 }
@@ -145,32 +286,3 @@ func (finder *ContainerInBridgeModeFinder) Find() (*docker.Container, error) {
 
 	return container, err
 }
-
-func findJobID(container *docker.Container, idPrefix string) (string, error) {
-	for _, envvar := range container.Config.Env {
-		if strings.HasPrefix(envvar, idPrefix) {
-			return strings.TrimPrefix(envvar, idPrefix), nil
-		}
-	}
-
-	return "", errors.Errorf("Couldn't get TARDIS_SCHID environment variable from container")
-}
-
-func DiscoverJobIDFromContainer(container *docker.Container, idPrefix string) (string, error) {
-	jobID, err := findJobID(container, idPrefix)
-	if err != nil {
-		log.Error(err)
-		return "", err
-	}
-
-	if isValidUUID(jobID) {
-		return jobID, nil
-	}
-
-	return "", errors.Errorf("SCHID \"%s\" is not a valid uuidv4", jobID)
-}
-
-func isValidUUID(uuid string) bool {
-	r := regexp.MustCompile("^[a-fA-F0-9]{8}-[a-fA-F0-9]{4}-4[a-fA-F0-9]{3}-[8|9|aA|bB][a-fA-F0-9]{3}-[a-fA-F0-9]{12}$")
-	return r.MatchString(uuid)
-}
@@ -1,59 +1,110 @@
 package pkg
 
 import (
-	"fmt"
 	log "github.com/Sirupsen/logrus"
-	"github.com/go-errors/errors"
+	"github.com/fsouza/go-dockerclient"
+	"net"
 	"net/http"
-	"os/exec"
-	"regexp"
-	"strconv"
-	"strings"
+	"time"
 )
 
 type JobFinder interface {
 	FindJobIdFromRequest(request *http.Request) (string, error)
 }
 
-func NewJobFinder(repository ContainerRepository, pidFinder PidFinder, hostIp, idPrefix string) JobFinder {
+// Job describes the job doing a request: its id and where it comes from
+type Job struct {
+	Id        string
+	Framework string
+	Image     string
+	// Mode tells how the container was found: host or bridge
+	Mode string
+}
+
+// JobInfoFinder is implemented by the job finders that can tell the framework and image of the job
+type JobInfoFinder interface {
+	FindJobFromRequest(request *http.Request) (*Job, error)
+}
+
+func NewJobFinder(repository ContainerRepository, pidFinder PidFinder, hostIps []string, jobIds *JobIdResolver) JobFinder {
 	return &ContainerJobFinder{
 		repository,
 		pidFinder,
-		hostIp,
-		idPrefix,
+		hostIps,
+		jobIds,
 	}
 }
 
 type ContainerJobFinder struct {
 	repository ContainerRepository
 	pidFinder  PidFinder
-	hostIp     string
-	idPrefix   string
+	hostIps    []string
+	jobIds     *JobIdResolver
 }
 
 func (finder *ContainerJobFinder) FindJobIdFromRequest(request *http.Request) (jobId string, err error) {
+	job, err := finder.FindJobFromRequest(request)
+	if err != nil {
+		return "", err
+	}
+
+	return job.Id, nil
+}
+
+func (finder *ContainerJobFinder) FindJobFromRequest(request *http.Request) (*Job, error) {
 	log.Debugf("Remote address: %s", request.RemoteAddr)
 	ip := getIp(request.RemoteAddr)
 
+	mode := finder.resolutionMode(ip)
+	start := time.Now()
 	containerFinder := finder.buildContainerFinder(ip, request)
 	container, err := containerFinder.Find()
 
 	if err != nil {
+		containerLookupDuration.ObserveSince(start, mode, "error")
 		log.Error(err.Error())
-		return "", err
+		return nil, err
 	}
+	containerLookupDuration.ObserveSince(start, mode, "found")
 
-	jobId, err = DiscoverJobIDFromContainer(container, finder.idPrefix)
+	jobId, err := finder.findJobId(container)
 	if err != nil {
 		log.Error(err.Error())
-		return "", err
+		return nil, err
 	}
 
-	return jobId, nil
+	job := &Job{Id: jobId, Mode: mode}
+	if container.Config != nil {
+		job.Framework = container.Config.Labels[FrameworkLabel]
+		job.Image = container.Config.Image
+	}
+
+	return job, nil
+}
+
+func (finder *ContainerJobFinder) findJobId(container *docker.Container) (string, error) {
+	if repository, ok := finder.repository.(JobIdRepository); ok {
+		if jobId, ok := repository.FindJobIdOfContainer(container.ID); ok {
+			return jobId, nil
+		}
+	}
+
+	return finder.jobIds.Resolve(container)
+}
+
+// resolutionMode tells if the container doing a request from ip has to be found in host or bridge mode
+func (finder *ContainerJobFinder) resolutionMode(ip string) string {
+	for _, hostIp := range finder.hostIps {
+		if sameIp(ip, hostIp) {
+			return "host"
+		}
+	}
+
+	return "bridge"
 }
 
 func (finder *ContainerJobFinder) buildContainerFinder(ip string, request *http.Request) (containerFinder ContainerFinder) {
-	if ip == finder.hostIp {
+	if finder.resolutionMode(ip) == "host" {
 		log.Debug("Container in host mode")
 
 		return &ContainerInHostModeFinder{
@@ -74,64 +125,23 @@ type PidFinder interface {
 	GetCommandPidByPort(port string) (int32, error)
 }
 
-func NewPidFinder() *CommandPidFinder {
-	return &CommandPidFinder{}
-}
-
-type CommandPidFinder struct {
-}
-
-func (finder *CommandPidFinder) GetCommandPidByPort(port string) (int32, error) {
-	command := fmt.Sprintf("sudo fuser %s/tcp", port)
-
-	lsofOutput, err := exec.Command("bash", "-c", command).CombinedOutput()
-
-	if err != nil {
-		log.Error(err.Error())
-		return 0, err
-	}
-
-	pid, err := finder.extractPidFromFuserCommand(string(lsofOutput[:]))
-
-	if err == nil {
-		return pid, nil
-	}
-
-	return 0, errors.Errorf("Can't get Pid by port %s", port)
-}
-
-func (finder *CommandPidFinder) extractPidFromFuserCommand(command_result string) (int32, error) {
-	RegexPid := regexp.MustCompile("(?s)^(\\d+)/tcp:\\s+(\\d+)(?s:.*)$")
-	match := RegexPid.FindStringSubmatch(command_result)
-
-	if match != nil {
-		log.Debug(fmt.Sprintf("Fuser result matches regexp"))
-		pid, err := strconv.ParseInt(match[2], 10, 32)
-
-		if err == nil {
-			return int32(pid), nil
-		}
-	}
-
-	return 0, errors.Errorf("Couldn't get PID")
-}
-
+// getPort returns the port of a host:port or [host]:port address, or the address when it has no port
 func getPort(addr string) string {
-	index := strings.Index(addr, ":")
-
-	if index < 0 {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
 		return addr
 	}
 
-	return addr[index+1:]
+	return port
 }
 
+// getIp returns the IPv4 or IPv6 address of a host:port or [host]:port address, or the address when it has
+// no port
 func getIp(addr string) string {
-	index := strings.Index(addr, ":")
-
-	if index < 0 {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
 		return addr
 	}
 
-	return addr[:index]
+	return host
 }
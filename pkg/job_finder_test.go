@@ -1,60 +1,14 @@
 package pkg
 
 import (
-	"fmt"
 	"github.com/fsouza/go-dockerclient"
 	"github.com/go-errors/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
-	"github.com/stretchr/testify/suite"
 	"net/http"
 	"testing"
 )
 
-type DiscoverJobIdFromContainerTestSuite struct {
-	suite.Suite
-	pidFinder *CommandPidFinder
-}
-
-func (suite *DiscoverJobIdFromContainerTestSuite) SetupTest() {
-	suite.pidFinder = NewPidFinder()
-}
-
-func (suite *DiscoverJobIdFromContainerTestSuite) TestExtractPortFromFuserCommand() {
-	cm := fmt.Sprintf("35812/tcp:           28320")
-
-	pid, err := suite.pidFinder.extractPidFromFuserCommand(cm)
-
-	if err != nil {
-		suite.T().Error(err)
-	}
-	assert.Equal(suite.T(), int32(28320), pid)
-}
-func (suite *DiscoverJobIdFromContainerTestSuite) TestExtractPortFromFuserCommandWithSeveralLines() {
-	cm := fmt.Sprintf("35812/tcp:           28320\n       ")
-
-	pid, err := suite.pidFinder.extractPidFromFuserCommand(cm)
-
-	if err != nil {
-		suite.T().Error(err)
-
-	}
-	assert.Equal(suite.T(), int32(28320), pid)
-}
-func (suite *DiscoverJobIdFromContainerTestSuite) TestExtractPortFromFuserCommandFailsIfComandOutputIsInvalid() {
-	pid, err := suite.pidFinder.extractPidFromFuserCommand("8080/tcp")
-
-	assert.Equal(suite.T(), int32(0), pid)
-
-	if err == nil {
-		suite.T().Error("Expected error didn't happen")
-	}
-}
-
-func TestDiscoverJobIdFromContainerTestSuite(t *testing.T) {
-	suite.Run(t, new(DiscoverJobIdFromContainerTestSuite))
-}
-
 func TestFindJobIdFromRequestWhenHostMode(t *testing.T) {
 	req, err := http.NewRequest("GET", "/v2/credentials", nil)
 	req.RemoteAddr = "52.52.52.52:10000"
@@ -69,8 +23,8 @@ func TestFindJobIdFromRequestWhenHostMode(t *testing.T) {
 	finder := ContainerJobFinder{
 		mockedRepository,
 		mockedPidFinder,
-		"52.52.52.52",
-		"TARDIS_SCHID=",
+		[]string{"52.52.52.52"},
+		NewJobIdResolver(NewUUIDv4JobIdValidator(), NewEnvJobIdSource("TARDIS_SCHID=")),
 	}
 
 	jobId, err := finder.FindJobIdFromRequest(req)
@@ -108,7 +62,7 @@ func TestFindJobIdFromRequestWhenBridgeMode(t *testing.T) {
 	finder := ContainerJobFinder{
 		repository: mockedRepository,
 		pidFinder:  mockedPidFinder,
-		idPrefix:   "TARDIS_SCHID=",
+		jobIds:     NewJobIdResolver(NewUUIDv4JobIdValidator(), NewEnvJobIdSource("TARDIS_SCHID=")),
 	}
 
 	jobId, err := finder.FindJobIdFromRequest(req)
@@ -120,6 +74,38 @@ func TestFindJobIdFromRequestWhenBridgeMode(t *testing.T) {
 	mockedRepository.AssertExpectations(t)
 }
 
+func TestFindJobIdFromRequestWithIPv6Addresses(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/v2/credentials", nil)
+	req.RemoteAddr = "[fd00:1::7]:10000"
+
+	container := &docker.Container{
+		Config: &docker.Config{
+			Env: []string{"TARDIS_SCHID=4ea13548-caa8-48dc-af69-58a651d9fa3b"},
+		},
+	}
+	mockedRepository := &MockedIpRepository{}
+	mockedRepository.On("FindContainerUsingIp", "fd00:1::7").Return(container, nil)
+
+	finder := ContainerJobFinder{
+		repository: mockedRepository,
+		hostIps:    []string{"52.52.52.52", "fd00:1::1"},
+		jobIds:     NewJobIdResolver(NewUUIDv4JobIdValidator(), NewEnvJobIdSource("TARDIS_SCHID=")),
+	}
+
+	jobId, err := finder.FindJobIdFromRequest(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "4ea13548-caa8-48dc-af69-58a651d9fa3b", jobId)
+	mockedRepository.AssertExpectations(t)
+
+	req.RemoteAddr = "[fd00:1:0::1]:10000"
+	finder.repository = getRepositoryMock()
+	finder.pidFinder = getPidFinderMock()
+
+	jobId, err = finder.FindJobIdFromRequest(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "4ea13548-caa8-48dc-af69-58a651d9fa3b", jobId)
+}
+
 func getRepositoryMock() *MockedCommandRepository {
 	container := &docker.Container{
 		Config: &docker.Config{
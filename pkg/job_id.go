@@ -0,0 +1,109 @@
+package pkg
+
+import (
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/go-errors/errors"
+	"strings"
+)
+
+// Prefix of the Docker labels holding the Mesos task labels
+const mesosTaskLabelPrefix = "label."
+
+// JobIdSource reads the job id of a container from one place of its configuration
+type JobIdSource interface {
+	FindJobId(container *docker.Container) (string, bool)
+	String() string
+}
+
+func NewDockerLabelJobIdSource(label string) *DockerLabelJobIdSource {
+	return &DockerLabelJobIdSource{label}
+}
+
+// DockerLabelJobIdSource reads the job id from a Docker label of the container
+type DockerLabelJobIdSource struct {
+	label string
+}
+
+func (source *DockerLabelJobIdSource) FindJobId(container *docker.Container) (string, bool) {
+	jobId, ok := container.Config.Labels[source.label]
+	return jobId, ok
+}
+
+func (source *DockerLabelJobIdSource) String() string {
+	return fmt.Sprintf("%s Docker label", source.label)
+}
+
+func NewMesosLabelJobIdSource(key string) *MesosLabelJobIdSource {
+	return &MesosLabelJobIdSource{key}
+}
+
+// MesosLabelJobIdSource reads the job id from a Mesos task label, which is propagated to the container as the
+// label.<key> label
+type MesosLabelJobIdSource struct {
+	key string
+}
+
+func (source *MesosLabelJobIdSource) FindJobId(container *docker.Container) (string, bool) {
+	jobId, ok := container.Config.Labels[mesosTaskLabelPrefix+source.key]
+	return jobId, ok
+}
+
+func (source *MesosLabelJobIdSource) String() string {
+	return fmt.Sprintf("%s Mesos task label", source.key)
+}
+
+func NewEnvJobIdSource(idPrefix string) *EnvJobIdSource {
+	return &EnvJobIdSource{idPrefix}
+}
+
+// EnvJobIdSource reads the job id from the environment variable of the container starting with idPrefix
+type EnvJobIdSource struct {
+	idPrefix string
+}
+
+func (source *EnvJobIdSource) FindJobId(container *docker.Container) (string, bool) {
+	for _, envvar := range container.Config.Env {
+		if strings.HasPrefix(envvar, source.idPrefix) {
+			return strings.TrimPrefix(envvar, source.idPrefix), true
+		}
+	}
+
+	return "", false
+}
+
+func (source *EnvJobIdSource) String() string {
+	return fmt.Sprintf("%s environment variable", strings.TrimSuffix(source.idPrefix, "="))
+}
+
+func NewJobIdResolver(validator JobIdValidator, sources ...JobIdSource) *JobIdResolver {
+	return &JobIdResolver{validator, sources}
+}
+
+// JobIdResolver reads the job id of a container from the first of its sources holding one, so that the
+// order of the sources defines their precedence
+type JobIdResolver struct {
+	validator JobIdValidator
+	sources   []JobIdSource
+}
+
+func (resolver *JobIdResolver) Resolve(container *docker.Container) (string, error) {
+	if container.Config == nil {
+		return "", errors.Errorf("Container %s has no configuration", container.ID)
+	}
+
+	names := []string{}
+	for _, source := range resolver.sources {
+		if jobId, ok := source.FindJobId(container); ok {
+			if err := resolver.validator.Validate(jobId); err != nil {
+				return "", errors.Errorf("SCHID %s", err)
+			}
+
+			return jobId, nil
+		}
+
+		names = append(names, source.String())
+	}
+
+	return "", errors.Errorf("Couldn't get %s from container", strings.Join(names, " or "))
+}
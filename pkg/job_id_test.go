@@ -0,0 +1,121 @@
+package pkg_test
+
+import (
+	"github.com/fsouza/go-dockerclient"
+	"github.com/schibsted/mesos2iam/pkg"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func newJobIdTestResolver() *pkg.JobIdResolver {
+	return pkg.NewJobIdResolver(
+		pkg.NewUUIDv4JobIdValidator(),
+		pkg.NewDockerLabelJobIdSource("mesos2iam.job-id"),
+		pkg.NewMesosLabelJobIdSource("mesos2iam.job-id"),
+		pkg.NewEnvJobIdSource("TARDIS_SCHID="),
+	)
+}
+
+func newEnvJobIdTestResolver() *pkg.JobIdResolver {
+	return pkg.NewJobIdResolver(pkg.NewUUIDv4JobIdValidator(), pkg.NewEnvJobIdSource("TARDIS_SCHID="))
+}
+
+func TestJobIdResolverFollowsThePrecedenceOfTheSources(t *testing.T) {
+	container := &docker.Container{
+		Config: &docker.Config{
+			Env: []string{"TARDIS_SCHID=4ea13548-caa8-48dc-af69-58a651d9fa3b"},
+			Labels: map[string]string{
+				"label.mesos2iam.job-id": "5c7d3e6a-1b2c-4d5e-8f90-a1b2c3d4e5f6",
+				"mesos2iam.job-id":       "9f1e2d3c-4b5a-4c6d-9e8f-0a1b2c3d4e5f",
+			},
+		},
+	}
+	resolver := newJobIdTestResolver()
+
+	jobId, err := resolver.Resolve(container)
+	assert.NoError(t, err)
+	assert.Equal(t, "9f1e2d3c-4b5a-4c6d-9e8f-0a1b2c3d4e5f", jobId)
+
+	delete(container.Config.Labels, "mesos2iam.job-id")
+	jobId, err = resolver.Resolve(container)
+	assert.NoError(t, err)
+	assert.Equal(t, "5c7d3e6a-1b2c-4d5e-8f90-a1b2c3d4e5f6", jobId)
+
+	delete(container.Config.Labels, "label.mesos2iam.job-id")
+	jobId, err = resolver.Resolve(container)
+	assert.NoError(t, err)
+	assert.Equal(t, "4ea13548-caa8-48dc-af69-58a651d9fa3b", jobId)
+}
+
+func TestJobIdResolverIgnoresTheEnvironmentWhenItIsNotASource(t *testing.T) {
+	container := &docker.Container{
+		Config: &docker.Config{
+			Env: []string{"TARDIS_SCHID=4ea13548-caa8-48dc-af69-58a651d9fa3b"},
+		},
+	}
+	resolver := pkg.NewJobIdResolver(pkg.NewUUIDv4JobIdValidator(), pkg.NewDockerLabelJobIdSource("mesos2iam.job-id"), pkg.NewMesosLabelJobIdSource("mesos2iam.job-id"))
+
+	_, err := resolver.Resolve(container)
+
+	if assert.Error(t, err) {
+		assert.Equal(t, "Couldn't get mesos2iam.job-id Docker label or mesos2iam.job-id Mesos task label from container", err.Error())
+	}
+}
+
+func TestJobIdResolverDoesNotFallBackWhenTheJobIdIsInvalid(t *testing.T) {
+	container := &docker.Container{
+		Config: &docker.Config{
+			Env:    []string{"TARDIS_SCHID=4ea13548-caa8-48dc-af69-58a651d9fa3b"},
+			Labels: map[string]string{"mesos2iam.job-id": "stupidcontent"},
+		},
+	}
+
+	_, err := newJobIdTestResolver().Resolve(container)
+
+	if assert.Error(t, err) {
+		assert.Equal(t, "SCHID \"stupidcontent\" is not a valid uuidv4", err.Error())
+	}
+}
+
+func TestEnvJobIdSourceReturnsTheJobId(t *testing.T) {
+	container := &docker.Container{
+		Config: &docker.Config{
+			Env: []string{"TARDIS_SCHID=4ea13548-caa8-48dc-af69-58a651d9fa3b"},
+		},
+	}
+
+	applicationName, err := newEnvJobIdTestResolver().Resolve(container)
+
+	assert.Equal(t, err, nil)
+	assert.Equal(t, "4ea13548-caa8-48dc-af69-58a651d9fa3b", applicationName)
+}
+
+func TestEnvJobIdSourceFailsIfTheVariableDoesNotExist(t *testing.T) {
+	container := &docker.Container{
+		Config: &docker.Config{
+			Env: []string{},
+		},
+	}
+
+	applicationName, err := newEnvJobIdTestResolver().Resolve(container)
+
+	if assert.Error(t, err, "An error was expected if TARDIS_SCHID envvar does not exist") {
+		assert.Equal(t, err.Error(), "Couldn't get TARDIS_SCHID environment variable from container")
+	}
+	assert.Equal(t, "", applicationName)
+}
+
+func TestEnvJobIdSourceFailsIfTheJobIdIsInvalid(t *testing.T) {
+	container := &docker.Container{
+		Config: &docker.Config{
+			Env: []string{"TARDIS_SCHID=stupidcontent"},
+		},
+	}
+
+	applicationName, err := newEnvJobIdTestResolver().Resolve(container)
+
+	if assert.Error(t, err, "An error was expected if TARDIS_SCHID does not contain a valid uuid") {
+		assert.Equal(t, err.Error(), "SCHID \"stupidcontent\" is not a valid uuidv4")
+	}
+	assert.Equal(t, "", applicationName)
+}
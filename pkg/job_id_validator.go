@@ -0,0 +1,71 @@
+package pkg
+
+import (
+	"github.com/go-errors/errors"
+	"regexp"
+	"strings"
+)
+
+var (
+	uuidv4Regexp = regexp.MustCompile("^[a-fA-F0-9]{8}-[a-fA-F0-9]{4}-4[a-fA-F0-9]{3}-[8|9|aA|bB][a-fA-F0-9]{3}-[a-fA-F0-9]{12}$")
+	uuidRegexp   = regexp.MustCompile("^[a-fA-F0-9]{8}-[a-fA-F0-9]{4}-[a-fA-F0-9]{4}-[a-fA-F0-9]{4}-[a-fA-F0-9]{12}$")
+)
+
+// JobIdValidator checks the format of the job ids before requesting their credentials. The error describes
+// why the job id is refused.
+type JobIdValidator interface {
+	Validate(jobId string) error
+}
+
+func NewUUIDv4JobIdValidator() *RegexpJobIdValidator {
+	return &RegexpJobIdValidator{uuidv4Regexp, "a valid uuidv4"}
+}
+
+func NewUUIDJobIdValidator() *RegexpJobIdValidator {
+	return &RegexpJobIdValidator{uuidRegexp, "a valid uuid"}
+}
+
+// NewRegexpJobIdValidator accepts the job ids fully matching pattern
+func NewRegexpJobIdValidator(pattern string) (*RegexpJobIdValidator, error) {
+	r, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return nil, errors.Errorf("Invalid job id pattern \"%s\": %s", pattern, err)
+	}
+
+	return &RegexpJobIdValidator{r, "matching " + pattern}, nil
+}
+
+type RegexpJobIdValidator struct {
+	regexp      *regexp.Regexp
+	description string
+}
+
+func (validator *RegexpJobIdValidator) Validate(jobId string) error {
+	if !validator.regexp.MatchString(jobId) {
+		return errors.Errorf("\"%s\" is not %s", jobId, validator.description)
+	}
+
+	return nil
+}
+
+func NewAllowListJobIdValidator(jobIds []string) *AllowListJobIdValidator {
+	allowed := map[string]bool{}
+	for _, jobId := range jobIds {
+		allowed[strings.TrimSpace(jobId)] = true
+	}
+
+	return &AllowListJobIdValidator{allowed}
+}
+
+// AllowListJobIdValidator only accepts a fixed list of job ids
+type AllowListJobIdValidator struct {
+	allowed map[string]bool
+}
+
+func (validator *AllowListJobIdValidator) Validate(jobId string) error {
+	if !validator.allowed[jobId] {
+		return errors.Errorf("\"%s\" is not an allowed job id", jobId)
+	}
+
+	return nil
+}
@@ -0,0 +1,38 @@
+package pkg_test
+
+import (
+	"github.com/schibsted/mesos2iam/pkg"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestUUIDJobIdValidators(t *testing.T) {
+	uuidv1 := "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+
+	assert.NoError(t, pkg.NewUUIDv4JobIdValidator().Validate("4ea13548-caa8-48dc-af69-58a651d9fa3b"))
+	assert.EqualError(t, pkg.NewUUIDv4JobIdValidator().Validate(uuidv1), "\""+uuidv1+"\" is not a valid uuidv4")
+	assert.NoError(t, pkg.NewUUIDJobIdValidator().Validate(uuidv1))
+	assert.EqualError(t, pkg.NewUUIDJobIdValidator().Validate("my-job"), "\"my-job\" is not a valid uuid")
+}
+
+func TestRegexpJobIdValidatorMatchesTheWholeJobId(t *testing.T) {
+	validator, err := pkg.NewRegexpJobIdValidator("[a-z0-9-]+")
+	assert.NoError(t, err)
+
+	assert.NoError(t, validator.Validate("my-job"))
+	assert.EqualError(t, validator.Validate("my-job/../other"), "\"my-job/../other\" is not matching [a-z0-9-]+")
+}
+
+func TestRegexpJobIdValidatorFailsWithInvalidPatterns(t *testing.T) {
+	_, err := pkg.NewRegexpJobIdValidator("[a-z")
+
+	assert.Error(t, err)
+}
+
+func TestAllowListJobIdValidator(t *testing.T) {
+	validator := pkg.NewAllowListJobIdValidator([]string{"my-job", "arn:aws:ecs:eu-west-1:123456789012:task/my-task"})
+
+	assert.NoError(t, validator.Validate("my-job"))
+	assert.NoError(t, validator.Validate("arn:aws:ecs:eu-west-1:123456789012:task/my-task"))
+	assert.EqualError(t, validator.Validate("other-job"), "\"other-job\" is not an allowed job id")
+}
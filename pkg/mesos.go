@@ -0,0 +1,374 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/go-errors/errors"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FrameworkLabel is the label of the containers holding the name of the Mesos framework that launched them.
+// It's set from the Mesos agent API by MesosContainerRepository and DockerFrameworkRepository; the label set
+// on a Docker container by whoever launched it is never trusted.
+const FrameworkLabel = "mesos.framework.name"
+
+// Prefix of the names the Docker containerizer gives to the containers, followed by the Mesos container id
+const mesosDockerNamePrefix = "mesos-"
+
+// Matches the ID of the top level Mesos container in the cgroup paths of its processes (/mesos/<id>)
+var mesosCgroupRegexp = regexp.MustCompile(`^/mesos/([0-9a-fA-F-]+)(?:/|$)`)
+
+type mesosContainer struct {
+	ContainerId string `json:"container_id"`
+	Status      struct {
+		ExecutorPid  int32 `json:"executor_pid"`
+		NetworkInfos []struct {
+			IpAddresses []struct {
+				IpAddress string `json:"ip_address"`
+			} `json:"ip_addresses"`
+		} `json:"network_infos"`
+	} `json:"status"`
+}
+
+type mesosLabels struct {
+	Labels []struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	} `json:"labels"`
+}
+
+type mesosState struct {
+	Frameworks []struct {
+		Name      string `json:"name"`
+		Executors []struct {
+			Container string `json:"container"`
+			Tasks     []struct {
+				Name      string          `json:"name"`
+				Labels    json.RawMessage `json:"labels"`
+				Container struct {
+					Docker struct {
+						Image string `json:"image"`
+					} `json:"docker"`
+					Mesos struct {
+						Image struct {
+							Docker struct {
+								Name string `json:"name"`
+							} `json:"docker"`
+						} `json:"image"`
+					} `json:"mesos"`
+				} `json:"container"`
+			} `json:"tasks"`
+		} `json:"executors"`
+	} `json:"frameworks"`
+}
+
+func NewMesosContainerRepository(agentUrl string) *MesosContainerRepository {
+	return &MesosContainerRepository{
+		agentUrl: strings.TrimSuffix(agentUrl, "/"),
+		netClient: &http.Client{
+			Timeout: time.Second * 5,
+		},
+		procRoot: "/proc",
+	}
+}
+
+// MesosContainerRepository finds the tasks launched by the Mesos containerizer through the /containers and
+// /state endpoints of the local Mesos agent. The containers are returned as Docker containers holding the
+// environment of the executor and the task labels. The environment of the other processes of the container
+// isn't used: any of them can exec with the job id of another job.
+// implements ContainerRepository
+type MesosContainerRepository struct {
+	agentUrl  string
+	netClient *http.Client
+	procRoot  string
+}
+
+func (repository *MesosContainerRepository) FindContainerUsingIp(ip string) (*docker.Container, error) {
+	containers, err := repository.containers()
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+
+	for _, container := range containers {
+		for _, address := range containerIpAddresses(container) {
+			if sameIp(address, ip) {
+				log.Debug("Found IP: ", ip)
+
+				return repository.buildContainer(container)
+			}
+		}
+	}
+
+	return nil, errors.Errorf("Mesos container with ip %s does not exist", ip)
+}
+
+func (repository *MesosContainerRepository) FindContainerUsingCommandPID(pid int32) (*docker.Container, error) {
+	containerId, err := repository.mesosContainerIdOfProcess(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	containers, err := repository.containers()
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+
+	for _, container := range containers {
+		if container.ContainerId == containerId {
+			log.Debugf("Process %d belongs to Mesos container %s", pid, containerId)
+
+			return repository.buildContainer(container)
+		}
+	}
+
+	return nil, errors.Errorf("Mesos container %s of process %d does not exist", containerId, pid)
+}
+
+func (repository *MesosContainerRepository) mesosContainerIdOfProcess(pid int32) (string, error) {
+	paths, err := readCgroupPaths(repository.procRoot, pid)
+	if err != nil {
+		return "", err
+	}
+
+	for _, path := range paths {
+		if match := mesosCgroupRegexp.FindStringSubmatch(path); match != nil {
+			return match[1], nil
+		}
+	}
+
+	return "", errors.Errorf("Process %d does not belong to a Mesos container", pid)
+}
+
+func (repository *MesosContainerRepository) buildContainer(container mesosContainer) (*docker.Container, error) {
+	state := mesosState{}
+	if err := repository.get("/state", &state); err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+
+	result := &docker.Container{
+		ID: container.ContainerId,
+		Config: &docker.Config{
+			Env:    repository.processEnv(container.Status.ExecutorPid),
+			Labels: map[string]string{},
+		},
+		State:           docker.State{Pid: int(container.Status.ExecutorPid)},
+		NetworkSettings: &docker.NetworkSettings{},
+	}
+
+	if addresses := containerIpAddresses(container); len(addresses) > 0 {
+		result.NetworkSettings.IPAddress = addresses[0]
+	}
+
+	for _, framework := range state.Frameworks {
+		for _, executor := range framework.Executors {
+			if executor.Container != container.ContainerId || len(executor.Tasks) == 0 {
+				continue
+			}
+
+			// the task labels are named as the Docker containerizer propagates them to the containers
+			task := executor.Tasks[0]
+			result.Name = task.Name
+			result.Config.Labels[FrameworkLabel] = framework.Name
+			result.Config.Image = task.Container.Mesos.Image.Docker.Name
+			if result.Config.Image == "" {
+				result.Config.Image = task.Container.Docker.Image
+			}
+			for key, value := range parseMesosLabels(task.Labels) {
+				result.Config.Labels[mesosTaskLabelPrefix+key] = value
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// FrameworkOfContainer returns the name of the framework of the executor running in the Mesos container
+func (repository *MesosContainerRepository) FrameworkOfContainer(containerId string) (string, error) {
+	state := mesosState{}
+	if err := repository.get("/state", &state); err != nil {
+		return "", err
+	}
+
+	for _, framework := range state.Frameworks {
+		for _, executor := range framework.Executors {
+			if executor.Container == containerId {
+				return framework.Name, nil
+			}
+		}
+	}
+
+	return "", errors.Errorf("No executor of the Mesos agent runs in container %s", containerId)
+}
+
+func (repository *MesosContainerRepository) processEnv(pid int32) []string {
+	buf, err := ioutil.ReadFile(filepath.Join(repository.procRoot, strconv.Itoa(int(pid)), "environ"))
+	if err != nil {
+		log.Debugf("Couldn't read environment of process %d: %s", pid, err)
+		return []string{}
+	}
+
+	env := []string{}
+	for _, envvar := range bytes.Split(buf, []byte{0}) {
+		if len(envvar) > 0 {
+			env = append(env, string(envvar))
+		}
+	}
+
+	return env
+}
+
+func (repository *MesosContainerRepository) containers() ([]mesosContainer, error) {
+	containers := []mesosContainer{}
+	err := repository.get("/containers", &containers)
+
+	return containers, err
+}
+
+func (repository *MesosContainerRepository) get(path string, result interface{}) error {
+	response, err := repository.netClient.Get(repository.agentUrl + path)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return errors.Errorf("Mesos agent returned status code %d for %s", response.StatusCode, path)
+	}
+
+	if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+		return errors.Errorf("Invalid response of Mesos agent for %s: %s", path, err)
+	}
+
+	return nil
+}
+
+func containerIpAddresses(container mesosContainer) []string {
+	addresses := []string{}
+	for _, networkInfo := range container.Status.NetworkInfos {
+		for _, address := range networkInfo.IpAddresses {
+			addresses = append(addresses, address.IpAddress)
+		}
+	}
+
+	return addresses
+}
+
+// parseMesosLabels reads task labels, which the agent renders either as a list of key/value objects or
+// wrapped in {"labels": [...]}
+func parseMesosLabels(raw json.RawMessage) map[string]string {
+	labels := map[string]string{}
+	if len(raw) == 0 {
+		return labels
+	}
+
+	wrapped := mesosLabels{}
+	if err := json.Unmarshal(raw, &wrapped.Labels); err != nil {
+		if err := json.Unmarshal(raw, &wrapped); err != nil {
+			log.Debug("Invalid Mesos task labels: ", err)
+			return labels
+		}
+	}
+
+	for _, label := range wrapped.Labels {
+		labels[label.Key] = label.Value
+	}
+
+	return labels
+}
+
+func NewDockerFrameworkRepository(repository ContainerRepository, agent *MesosContainerRepository) *DockerFrameworkRepository {
+	return &DockerFrameworkRepository{repository, agent}
+}
+
+// DockerFrameworkRepository sets the framework of the containers of the Docker containerizer found by
+// repository from the Mesos agent, replacing the FrameworkLabel any task can set on its container. Containers
+// that weren't launched by the agent have no framework.
+// implements ContainerRepository and JobIdRepository
+type DockerFrameworkRepository struct {
+	repository ContainerRepository
+	agent      *MesosContainerRepository
+}
+
+func (repository *DockerFrameworkRepository) FindContainerUsingIp(ip string) (*docker.Container, error) {
+	container, err := repository.repository.FindContainerUsingIp(ip)
+	if err != nil {
+		return nil, err
+	}
+
+	return repository.withFramework(container), nil
+}
+
+func (repository *DockerFrameworkRepository) FindContainerUsingCommandPID(pid int32) (*docker.Container, error) {
+	container, err := repository.repository.FindContainerUsingCommandPID(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	return repository.withFramework(container), nil
+}
+
+func (repository *DockerFrameworkRepository) FindJobIdOfContainer(containerId string) (string, bool) {
+	if jobIds, ok := repository.repository.(JobIdRepository); ok {
+		return jobIds.FindJobIdOfContainer(containerId)
+	}
+
+	return "", false
+}
+
+// withFramework returns a copy of the container with the framework found in the Mesos agent, the container
+// may be shared with other requests
+func (repository *DockerFrameworkRepository) withFramework(container *docker.Container) *docker.Container {
+	copied := *container
+	if container.Config == nil {
+		return &copied
+	}
+
+	config := *container.Config
+	config.Labels = map[string]string{}
+	for key, value := range container.Config.Labels {
+		config.Labels[key] = value
+	}
+	delete(config.Labels, FrameworkLabel)
+	copied.Config = &config
+
+	containerId, ok := mesosContainerIdOfDockerName(container.Name)
+	if !ok {
+		log.Debugf("Docker container %s wasn't launched by the Mesos agent, it has no framework", container.ID)
+		return &copied
+	}
+
+	framework, err := repository.agent.FrameworkOfContainer(containerId)
+	if err != nil {
+		log.Warnf("Couldn't find the framework of Docker container %s: %s", container.ID, err)
+		return &copied
+	}
+
+	config.Labels[FrameworkLabel] = framework
+	return &copied
+}
+
+// mesosContainerIdOfDockerName reads the Mesos container id in the names of the Docker containerizer:
+// mesos-<container id>, mesos-<container id>.executor for the Docker executor, or mesos-<agent id>.<container
+// id> before Mesos 1.0
+func mesosContainerIdOfDockerName(name string) (string, bool) {
+	name = strings.TrimPrefix(name, "/")
+	if !strings.HasPrefix(name, mesosDockerNamePrefix) {
+		return "", false
+	}
+
+	parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(name, mesosDockerNamePrefix), ".executor"), ".")
+	containerId := parts[len(parts)-1]
+
+	return containerId, containerId != ""
+}
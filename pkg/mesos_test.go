@@ -0,0 +1,183 @@
+package pkg
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const mesosContainers = `[
+  {
+    "container_id": "3a5b6c7d-1111-2222-3333-444455556666",
+    "executor_id": "my-task.1234",
+    "framework_id": "framework-1",
+    "status": {
+      "executor_pid": 100,
+      "network_infos": [{"ip_addresses": [{"protocol": "IPv4", "ip_address": "10.1.0.5"}]}]
+    }
+  }
+]`
+
+const mesosAgentState = `{
+  "frameworks": [
+    {
+      "name": "marathon",
+      "executors": [
+        {
+          "container": "3a5b6c7d-1111-2222-3333-444455556666",
+          "tasks": [
+            {
+              "name": "my-task",
+              "labels": [{"key": "team", "value": "core"}],
+              "container": {"type": "MESOS", "mesos": {"image": {"type": "DOCKER", "docker": {"name": "team/my-task:1.0"}}}}
+            }
+          ]
+        }
+      ]
+    }
+  ]
+}`
+
+func newMesosTestRepository(t *testing.T) (*MesosContainerRepository, func()) {
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/containers":
+			w.Write([]byte(mesosContainers))
+		case "/state":
+			w.Write([]byte(mesosAgentState))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	procRoot, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		"100/cgroup":  "4:memory:/mesos/3a5b6c7d-1111-2222-3333-444455556666\n",
+		"100/environ": "PATH=/usr/bin\x00TARDIS_SCHID=4ea13548-caa8-48dc-af69-58a651d9fa3b\x00",
+		"101/cgroup":  "4:memory:/mesos/3a5b6c7d-1111-2222-3333-444455556666\n",
+		"101/environ": "PATH=/usr/bin\x00TARDIS_SCHID=b5a8e2f4-6d5c-4a3e-9f1b-2c3d4e5f6a7b\x00",
+		"200/cgroup":  "4:memory:/user.slice\n",
+	}
+	for name, content := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(procRoot, name)), 0755)
+		ioutil.WriteFile(filepath.Join(procRoot, name), []byte(content), 0644)
+	}
+
+	repository := NewMesosContainerRepository(agent.URL)
+	repository.procRoot = procRoot
+
+	return repository, func() {
+		agent.Close()
+		os.RemoveAll(procRoot)
+	}
+}
+
+func TestMesosContainerRepositoryFindsContainerUsingIp(t *testing.T) {
+	repository, cleanup := newMesosTestRepository(t)
+	defer cleanup()
+
+	container, err := repository.FindContainerUsingIp("10.1.0.5")
+
+	assert.NoError(t, err)
+	assert.Equal(t, "3a5b6c7d-1111-2222-3333-444455556666", container.ID)
+	assert.Equal(t, "my-task", container.Name)
+	assert.Equal(t, "core", container.Config.Labels["label.team"])
+	assert.Equal(t, "marathon", container.Config.Labels[FrameworkLabel])
+	assert.Equal(t, "team/my-task:1.0", container.Config.Image)
+	assert.Equal(t, "10.1.0.5", container.NetworkSettings.IPAddress)
+
+	jobId, err := NewJobIdResolver(NewUUIDv4JobIdValidator(), NewEnvJobIdSource("TARDIS_SCHID=")).Resolve(container)
+	assert.NoError(t, err)
+	assert.Equal(t, "4ea13548-caa8-48dc-af69-58a651d9fa3b", jobId)
+}
+
+func TestMesosContainerRepositoryFindsContainerUsingCommandPID(t *testing.T) {
+	repository, cleanup := newMesosTestRepository(t)
+	defer cleanup()
+
+	container, err := repository.FindContainerUsingCommandPID(101)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "3a5b6c7d-1111-2222-3333-444455556666", container.ID)
+	assert.Equal(t, 100, container.State.Pid)
+}
+
+func TestMesosContainerRepositoryOnlyReadsTheEnvironmentOfTheExecutor(t *testing.T) {
+	repository, cleanup := newMesosTestRepository(t)
+	defer cleanup()
+
+	// Process 101 of the task runs with the job id of another job
+	container, err := repository.FindContainerUsingCommandPID(101)
+	assert.NoError(t, err)
+
+	jobId, err := NewJobIdResolver(NewUUIDv4JobIdValidator(), NewEnvJobIdSource("TARDIS_SCHID=")).Resolve(container)
+	assert.NoError(t, err)
+	assert.Equal(t, "4ea13548-caa8-48dc-af69-58a651d9fa3b", jobId)
+
+	// Without job id in the executor environment, e.g. with the command executor, none is found
+	ioutil.WriteFile(filepath.Join(repository.procRoot, "100", "environ"), []byte("PATH=/usr/bin\x00"), 0644)
+	container, err = repository.FindContainerUsingCommandPID(101)
+	assert.NoError(t, err)
+
+	_, err = NewJobIdResolver(NewUUIDv4JobIdValidator(), NewEnvJobIdSource("TARDIS_SCHID=")).Resolve(container)
+	assert.Error(t, err)
+}
+
+func TestDockerFrameworkRepositorySetsTheFrameworkFromTheAgent(t *testing.T) {
+	agent, cleanup := newMesosTestRepository(t)
+	defer cleanup()
+
+	launched := newIndexedContainer("launched", "172.17.0.2", 100)
+	launched.Name = "/mesos-3a5b6c7d-1111-2222-3333-444455556666"
+	launched.Config.Labels = map[string]string{FrameworkLabel: "forged"}
+	manual := newIndexedContainer("manual", "172.17.0.3", 200)
+	manual.Name = "/my-container"
+	manual.Config.Labels = map[string]string{FrameworkLabel: "marathon"}
+
+	index := NewDockerContainerIndex(newFakeDockerClient(launched, manual), NewJobIdResolver(NewUUIDv4JobIdValidator(), NewEnvJobIdSource("TARDIS_SCHID=")), nil)
+	assert.NoError(t, index.Resync())
+	repository := NewDockerFrameworkRepository(index, agent)
+
+	container, err := repository.FindContainerUsingIp("172.17.0.2")
+	assert.NoError(t, err)
+	assert.Equal(t, "marathon", container.Config.Labels[FrameworkLabel])
+	assert.Equal(t, "forged", launched.Config.Labels[FrameworkLabel], "The indexed container isn't modified")
+
+	container, err = repository.FindContainerUsingIp("172.17.0.3")
+	assert.NoError(t, err)
+	_, ok := container.Config.Labels[FrameworkLabel]
+	assert.False(t, ok)
+
+	jobId, ok := repository.FindJobIdOfContainer("launched")
+	assert.True(t, ok)
+	assert.Equal(t, "4ea13548-caa8-48dc-af69-58a651d9fa3b", jobId)
+}
+
+func TestMesosContainerIdOfDockerName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"/mesos-3a5b6c7d-1111-2222-3333-444455556666":                      "3a5b6c7d-1111-2222-3333-444455556666",
+		"/mesos-3a5b6c7d-1111-2222-3333-444455556666.executor":             "3a5b6c7d-1111-2222-3333-444455556666",
+		"/mesos-20170801-000000-1-S0.3a5b6c7d-1111-2222-3333-444455556666": "3a5b6c7d-1111-2222-3333-444455556666",
+		"/my-container": "",
+	} {
+		containerId, _ := mesosContainerIdOfDockerName(name)
+		assert.Equal(t, expected, containerId, name)
+	}
+}
+
+func TestMesosContainerRepositoryFailsForHostProcesses(t *testing.T) {
+	repository, cleanup := newMesosTestRepository(t)
+	defer cleanup()
+
+	_, err := repository.FindContainerUsingCommandPID(200)
+
+	assert.Error(t, err)
+}
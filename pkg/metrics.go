@@ -0,0 +1,17 @@
+package pkg
+
+import "github.com/schibsted/mesos2iam/metrics"
+
+var (
+	containerLookupDuration = metrics.NewHistogramVec("mesos2iam_container_lookup_duration_seconds",
+		"Time to find the container doing a request, by resolution mode (host or bridge) and result", "mode", "result")
+	dockerApiErrors = metrics.NewCounterVec("mesos2iam_docker_api_errors_total",
+		"Failed calls to the Docker API, by operation", "operation")
+)
+
+// countDockerError counts the errors of the Docker API calls
+func countDockerError(operation string, err error) {
+	if err != nil {
+		dockerApiErrors.Inc(operation)
+	}
+}
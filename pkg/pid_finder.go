@@ -0,0 +1,225 @@
+package pkg
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-errors/errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// tcpListen is the state of listening sockets in /proc/net/tcp
+const tcpListen = "0A"
+
+// NewProcPidFinder finds the processes connected from one of the localIps to one of the remoteAddresses, the host:port
+// addresses a request to mesos2iam can be sent to, e.g. its listening address or the redirected
+// 169.254.170.2:80.
+func NewProcPidFinder(localIps []string, remoteAddresses []string) (*ProcPidFinder, error) {
+	remotes := []procNetAddress{}
+	for _, address := range remoteAddresses {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, errors.Errorf("Invalid remote address %s: %s", address, err)
+		}
+
+		remote, err := strconv.ParseUint(port, 10, 16)
+		if err != nil || net.ParseIP(host) == nil {
+			return nil, errors.Errorf("Invalid remote address %s", address)
+		}
+
+		remotes = append(remotes, procNetAddress{net.ParseIP(host), uint16(remote)})
+	}
+
+	locals := []net.IP{}
+	for _, localIp := range localIps {
+		ip := net.ParseIP(localIp)
+		if ip == nil {
+			return nil, errors.Errorf("Invalid local IP %s", localIp)
+		}
+		locals = append(locals, ip)
+	}
+
+	return &ProcPidFinder{
+		procRoot: "/proc",
+		localIps: locals,
+		remotes:  remotes,
+	}, nil
+}
+
+// ProcPidFinder finds the process owning a TCP connection reading /proc/net/tcp and /proc/net/tcp6, then
+// looking for the socket inode among the file descriptors of every process.
+// implements PidFinder
+type ProcPidFinder struct {
+	procRoot string
+	localIps []net.IP
+	remotes  []procNetAddress
+}
+
+type procNetAddress struct {
+	ip   net.IP
+	port uint16
+}
+
+func (finder *ProcPidFinder) GetCommandPidByPort(port string) (int32, error) {
+	localPort, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return 0, errors.Errorf("Invalid port %s", port)
+	}
+
+	inode, err := finder.findSocketInode(uint16(localPort))
+	if err != nil {
+		log.Error(err.Error())
+		return 0, err
+	}
+
+	log.Debugf("Socket inode of port %s: %s", port, inode)
+
+	return finder.findSocketOwner(inode)
+}
+
+func (finder *ProcPidFinder) findSocketInode(localPort uint16) (string, error) {
+	for _, table := range []string{"tcp", "tcp6"} {
+		inode, err := finder.findSocketInodeInTable(filepath.Join(finder.procRoot, "net", table), localPort)
+		if err != nil {
+			return "", err
+		}
+
+		if inode != "" {
+			return inode, nil
+		}
+	}
+
+	return "", errors.Errorf("Can't find a socket with local port %d", localPort)
+}
+
+func (finder *ProcPidFinder) findSocketInodeInTable(path string, localPort uint16) (string, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	// Skip the header
+	scanner.Scan()
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// Sockets without inode, e.g. in TIME_WAIT, are closed and owned by no process
+		if len(fields) < 10 || fields[3] == tcpListen || fields[9] == "0" {
+			continue
+		}
+
+		ip, port, err := parseProcNetAddress(fields[1])
+		if err != nil {
+			log.Debug(err.Error())
+			continue
+		}
+
+		if port != localPort || !finder.connectedFrom(ip) {
+			continue
+		}
+
+		remoteIp, remotePort, err := parseProcNetAddress(fields[2])
+		if err != nil {
+			log.Debug(err.Error())
+			continue
+		}
+
+		if finder.connectedTo(remoteIp, remotePort) {
+			return fields[9], nil
+		}
+	}
+
+	return "", scanner.Err()
+}
+
+// connectedFrom tells if the local end of a socket is one of the addresses of the host, any local end matches
+// when there are none
+func (finder *ProcPidFinder) connectedFrom(ip net.IP) bool {
+	if len(finder.localIps) == 0 {
+		return true
+	}
+
+	for _, local := range finder.localIps {
+		if local.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// connectedTo tells if the remote end of a socket is one of the addresses of mesos2iam, any remote end
+// matches when there are none
+func (finder *ProcPidFinder) connectedTo(ip net.IP, port uint16) bool {
+	if len(finder.remotes) == 0 {
+		return true
+	}
+
+	for _, remote := range finder.remotes {
+		if remote.port == port && remote.ip.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (finder *ProcPidFinder) findSocketOwner(inode string) (int32, error) {
+	fds, err := filepath.Glob(filepath.Join(finder.procRoot, "[0-9]*", "fd", "*"))
+	if err != nil {
+		return 0, err
+	}
+
+	socket := fmt.Sprintf("socket:[%s]", inode)
+	for _, fd := range fds {
+		link, err := os.Readlink(fd)
+		if err != nil || link != socket {
+			continue
+		}
+
+		pid, err := strconv.ParseInt(filepath.Base(filepath.Dir(filepath.Dir(fd))), 10, 32)
+		if err != nil {
+			continue
+		}
+
+		return int32(pid), nil
+	}
+
+	return 0, errors.Errorf("Can't find the process owning socket %s", inode)
+}
+
+// parseProcNetAddress decodes addresses like 0100007F:1F90, where the IP is written as native endian
+// (little endian in practice) 32 bit words.
+func parseProcNetAddress(address string) (net.IP, uint16, error) {
+	parts := strings.Split(address, ":")
+	if len(parts) != 2 {
+		return nil, 0, errors.Errorf("Invalid address %s", address)
+	}
+
+	words, err := hex.DecodeString(parts[0])
+	if err != nil || (len(words) != net.IPv4len && len(words) != net.IPv6len) {
+		return nil, 0, errors.Errorf("Invalid IP in address %s", address)
+	}
+
+	ip := make(net.IP, len(words))
+	for i := 0; i < len(words); i += 4 {
+		ip[i], ip[i+1], ip[i+2], ip[i+3] = words[i+3], words[i+2], words[i+1], words[i]
+	}
+
+	port, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return nil, 0, errors.Errorf("Invalid port in address %s", address)
+	}
+
+	return ip, uint16(port), nil
+}
@@ -0,0 +1,141 @@
+package pkg
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const procNetTcp = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:C82F 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 11111 1 0000000000000000 100 0 0 10 0
+   1: 3434343A:2710 02AAFEA9:0050 01 00000000:00000000 00:00000000 00000000  1000        0 22222 1 0000000000000000 20 4 30 10 -1
+   2: 0100007F:2710 0100007F:1F90 01 00000000:00000000 00:00000000 00000000  1000        0 33333 1 0000000000000000 20 4 30 10 -1
+   3: 3434343A:2712 02AAFEA9:0050 06 00000000:00000000 03:00000A4B 00000000     0        0 0 3 0000000000000000
+   4: 3434343A:2712 0100007F:0CEA 01 00000000:00000000 00:00000000 00000000  1000        0 55555 1 0000000000000000 20 4 30 10 -1
+   5: 3434343A:2712 3434343A:1F90 01 00000000:00000000 00:00000000 00000000  1000        0 66666 1 0000000000000000 20 4 30 10 -1
+`
+
+const procNetTcp6 = `  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 000080FE00000000FF00000001000000:2711 000080FE00000000FF00000002000000:0050 01 00000000:00000000 00:00000000 00000000  1000        0 44444 1 0000000000000000 20 4 30 10 -1
+`
+
+// requestAddresses are the addresses of mesos2iam in the fake /proc
+var requestAddresses = []procNetAddress{
+	{net.ParseIP("58.52.52.52"), 8080},
+	{net.ParseIP("127.0.0.1"), 8080},
+	{net.ParseIP("169.254.170.2"), 80},
+	{net.ParseIP("fe80::ff:0:2"), 80},
+}
+
+func buildFakeProc(t *testing.T) string {
+	procRoot, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		"net/tcp":  procNetTcp,
+		"net/tcp6": procNetTcp6,
+	}
+	for name, content := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(procRoot, name)), 0755)
+		ioutil.WriteFile(filepath.Join(procRoot, name), []byte(content), 0644)
+	}
+
+	sockets := map[string]string{
+		"100/fd/3": "socket:[33333]",
+		"200/fd/0": "/dev/null",
+		"200/fd/7": "socket:[22222]",
+		"300/fd/4": "socket:[44444]",
+		"400/fd/5": "socket:[55555]",
+		"500/fd/6": "socket:[66666]",
+	}
+	for name, target := range sockets {
+		os.MkdirAll(filepath.Dir(filepath.Join(procRoot, name)), 0755)
+		os.Symlink(target, filepath.Join(procRoot, name))
+	}
+
+	return procRoot
+}
+
+func TestProcPidFinderFindsOwnerOfSocket(t *testing.T) {
+	procRoot := buildFakeProc(t)
+	defer os.RemoveAll(procRoot)
+
+	finder := &ProcPidFinder{procRoot, []net.IP{net.ParseIP("58.52.52.52")}, requestAddresses}
+	pid, err := finder.GetCommandPidByPort("10000")
+
+	assert.NoError(t, err)
+	assert.Equal(t, int32(200), pid)
+}
+
+func TestProcPidFinderMatchesLocalAddress(t *testing.T) {
+	procRoot := buildFakeProc(t)
+	defer os.RemoveAll(procRoot)
+
+	finder := &ProcPidFinder{procRoot, []net.IP{net.ParseIP("127.0.0.1")}, requestAddresses}
+	pid, err := finder.GetCommandPidByPort("10000")
+
+	assert.NoError(t, err)
+	assert.Equal(t, int32(100), pid)
+}
+
+func TestProcPidFinderFindsIPv6Sockets(t *testing.T) {
+	procRoot := buildFakeProc(t)
+	defer os.RemoveAll(procRoot)
+
+	finder := &ProcPidFinder{procRoot, []net.IP{net.ParseIP("58.52.52.52"), net.ParseIP("fe80::ff:0:1")}, requestAddresses}
+	pid, err := finder.GetCommandPidByPort("10001")
+
+	assert.NoError(t, err)
+	assert.Equal(t, int32(300), pid)
+}
+
+func TestProcPidFinderFailsIfThereIsNoSocket(t *testing.T) {
+	procRoot := buildFakeProc(t)
+	defer os.RemoveAll(procRoot)
+
+	finder := &ProcPidFinder{procRoot, nil, requestAddresses}
+	pid, err := finder.GetCommandPidByPort("51234")
+
+	assert.Error(t, err)
+	assert.Equal(t, int32(0), pid)
+}
+
+func TestProcPidFinderMatchesRemoteAddress(t *testing.T) {
+	procRoot := buildFakeProc(t)
+	defer os.RemoveAll(procRoot)
+
+	// Port 10002 is also the local port of a closed socket and of a connection to another service
+	finder := &ProcPidFinder{procRoot, []net.IP{net.ParseIP("58.52.52.52")}, requestAddresses}
+	pid, err := finder.GetCommandPidByPort("10002")
+
+	assert.NoError(t, err)
+	assert.Equal(t, int32(500), pid)
+}
+
+func TestProcPidFinderSkipsClosedSockets(t *testing.T) {
+	procRoot := buildFakeProc(t)
+	defer os.RemoveAll(procRoot)
+
+	finder := &ProcPidFinder{procRoot, []net.IP{net.ParseIP("58.52.52.52")}, []procNetAddress{{net.ParseIP("169.254.170.2"), 80}}}
+	pid, err := finder.GetCommandPidByPort("10002")
+
+	assert.Error(t, err)
+	assert.Equal(t, int32(0), pid)
+}
+
+func TestNewProcPidFinderRejectsInvalidAddresses(t *testing.T) {
+	_, err := NewProcPidFinder([]string{"58.52.52.52"}, []string{"169.254.170.2"})
+	assert.Error(t, err)
+
+	_, err = NewProcPidFinder([]string{"host"}, []string{"169.254.170.2:80"})
+	assert.Error(t, err)
+
+	finder, err := NewProcPidFinder([]string{"58.52.52.52"}, []string{"169.254.170.2:80", "[fe80::1]:8080"})
+	assert.NoError(t, err)
+	assert.Len(t, finder.remotes, 2)
+}
@@ -0,0 +1,190 @@
+package pkg
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-errors/errors"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RoleMappingRule allows the jobs matching all its selectors to assume its roles. Selectors are lists of
+// values or patterns where * matches any text; an empty selector matches every job.
+type RoleMappingRule struct {
+	Jobs       []string `yaml:"jobs"`
+	Frameworks []string `yaml:"frameworks"`
+	Images     []string `yaml:"images"`
+	Roles      []string `yaml:"roles"`
+}
+
+type roleMappingFile struct {
+	// deny (default) refuses the credentials of jobs not matching any rule, allow serves them
+	Default string            `yaml:"default"`
+	Rules   []RoleMappingRule `yaml:"rules"`
+}
+
+type compiledRoleMappingRule struct {
+	jobs       []*regexp.Regexp
+	frameworks []*regexp.Regexp
+	images     []*regexp.Regexp
+	roles      []*regexp.Regexp
+}
+
+// NewRoleMappingFromFile loads the roles every job may assume from a YAML or JSON file:
+//
+//	default: deny
+//	rules:
+//	  - jobs: ["team-a-*"]
+//	    frameworks: ["marathon"]
+//	    images: ["registry.example.com/team-a/*"]
+//	    roles: ["arn:aws:iam::123456789012:role/team-a-*"]
+func NewRoleMappingFromFile(path string) (*RoleMapping, error) {
+	mapping := &RoleMapping{path: path}
+	if err := mapping.Reload(); err != nil {
+		return nil, err
+	}
+
+	return mapping, nil
+}
+
+// RoleMapping tells which roles a job may assume, so credentials of other roles returned by the backend
+// aren't served to it. The file is reloaded when it changes.
+type RoleMapping struct {
+	path string
+
+	mutex          sync.RWMutex
+	modTime        time.Time
+	allowUnmatched bool
+	rules          []compiledRoleMappingRule
+}
+
+// Start reloads the mapping every interval when the file has changed, until stop is closed. A file that
+// can't be loaded is logged and the previous mapping is kept.
+func (m *RoleMapping) Start(interval time.Duration, stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := m.Reload(); err != nil {
+					log.Error("Couldn't reload role mapping: ", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Reload loads the file again if it has been modified since it was loaded
+func (m *RoleMapping) Reload() error {
+	info, err := os.Stat(m.path)
+	if err != nil {
+		return err
+	}
+
+	m.mutex.RLock()
+	unchanged := info.ModTime().Equal(m.modTime)
+	m.mutex.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	buf, err := ioutil.ReadFile(m.path)
+	if err != nil {
+		return err
+	}
+
+	file := roleMappingFile{}
+	if err := yaml.Unmarshal(buf, &file); err != nil {
+		return errors.Errorf("Invalid role mapping %s: %s", m.path, err)
+	}
+
+	if file.Default != "" && file.Default != "deny" && file.Default != "allow" {
+		return errors.Errorf("Invalid default \"%s\" in role mapping %s, must be deny or allow", file.Default, m.path)
+	}
+
+	rules := []compiledRoleMappingRule{}
+	for i, rule := range file.Rules {
+		if len(rule.Roles) == 0 {
+			return errors.Errorf("Rule %d of role mapping %s has no roles", i+1, m.path)
+		}
+
+		rules = append(rules, compiledRoleMappingRule{
+			jobs:       compilePatterns(rule.Jobs),
+			frameworks: compilePatterns(rule.Frameworks),
+			images:     compilePatterns(rule.Images),
+			roles:      compilePatterns(rule.Roles),
+		})
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.modTime = info.ModTime()
+	m.allowUnmatched = file.Default == "allow"
+	m.rules = rules
+
+	log.Infof("Loaded %d rules from role mapping %s", len(rules), m.path)
+	return nil
+}
+
+// Allow returns an error telling why the job can't assume the role, or nil if it can
+func (m *RoleMapping) Allow(job *Job, roleArn string) error {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	matched := false
+	for _, rule := range m.rules {
+		if !matchesAny(rule.jobs, job.Id) || !matchesAny(rule.frameworks, job.Framework) || !matchesAny(rule.images, job.Image) {
+			continue
+		}
+
+		matched = true
+		if roleArn != "" && matchesAny(rule.roles, roleArn) {
+			return nil
+		}
+	}
+
+	if matched {
+		return errors.Errorf("Job %s is not allowed to assume role %s", job.Id, roleArn)
+	}
+
+	if m.allowUnmatched {
+		return nil
+	}
+
+	return errors.Errorf("Job %s (framework \"%s\", image \"%s\") doesn't match any rule of the role mapping", job.Id, job.Framework, job.Image)
+}
+
+// compilePatterns turns the patterns of a selector into regular expressions where * matches any text
+func compilePatterns(patterns []string) []*regexp.Regexp {
+	compiled := []*regexp.Regexp{}
+	for _, pattern := range patterns {
+		quoted := strings.Replace(regexp.QuoteMeta(pattern), `\*`, ".*", -1)
+		compiled = append(compiled, regexp.MustCompile("^"+quoted+"$"))
+	}
+
+	return compiled
+}
+
+// matchesAny tells if value matches any of the patterns of a selector, an empty selector matching anything
+func matchesAny(patterns []*regexp.Regexp, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		if pattern.MatchString(value) {
+			return true
+		}
+	}
+
+	return false
+}
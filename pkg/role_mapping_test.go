@@ -0,0 +1,81 @@
+package pkg
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testRoleMapping = `
+rules:
+  - jobs: ["4ea13548-caa8-48dc-af69-58a651d9fa3b"]
+    roles: ["arn:aws:iam::123456789012:role/my-role"]
+  - frameworks: ["marathon"]
+    images: ["registry.example.com/team-a/*"]
+    roles: ["arn:aws:iam::123456789012:role/team-a-*"]
+`
+
+func writeRoleMapping(t *testing.T, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "role-mapping")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "roles.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestRoleMappingAllowsTheRolesOfTheMatchingRules(t *testing.T) {
+	path, cleanup := writeRoleMapping(t, testRoleMapping)
+	defer cleanup()
+
+	mapping, err := NewRoleMappingFromFile(path)
+	assert.NoError(t, err)
+
+	job := &Job{Id: "4ea13548-caa8-48dc-af69-58a651d9fa3b"}
+	assert.NoError(t, mapping.Allow(job, "arn:aws:iam::123456789012:role/my-role"))
+	assert.EqualError(t, mapping.Allow(job, "arn:aws:iam::123456789012:role/admin"),
+		"Job 4ea13548-caa8-48dc-af69-58a651d9fa3b is not allowed to assume role arn:aws:iam::123456789012:role/admin")
+
+	job = &Job{Id: "other", Framework: "marathon", Image: "registry.example.com/team-a/app:1.0"}
+	assert.NoError(t, mapping.Allow(job, "arn:aws:iam::123456789012:role/team-a-app"))
+
+	job.Framework = "chronos"
+	assert.Error(t, mapping.Allow(job, "arn:aws:iam::123456789012:role/team-a-app"), "Unmatched jobs are denied by default")
+}
+
+func TestRoleMappingCanAllowUnmatchedJobs(t *testing.T) {
+	path, cleanup := writeRoleMapping(t, `{"default": "allow", "rules": [{"jobs": ["my-job"], "roles": ["my-role"]}]}`)
+	defer cleanup()
+
+	mapping, err := NewRoleMappingFromFile(path)
+	assert.NoError(t, err)
+
+	assert.NoError(t, mapping.Allow(&Job{Id: "other-job"}, "any-role"))
+	assert.Error(t, mapping.Allow(&Job{Id: "my-job"}, "any-role"))
+}
+
+func TestRoleMappingIsReloadedWhenItChanges(t *testing.T) {
+	path, cleanup := writeRoleMapping(t, testRoleMapping)
+	defer cleanup()
+
+	mapping, err := NewRoleMappingFromFile(path)
+	assert.NoError(t, err)
+
+	ioutil.WriteFile(path, []byte("default: allow\n"), 0644)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Minute))
+	assert.NoError(t, mapping.Reload())
+	assert.NoError(t, mapping.Allow(&Job{Id: "other"}, "any-role"))
+
+	ioutil.WriteFile(path, []byte("default: maybe\n"), 0644)
+	os.Chtimes(path, time.Now(), time.Now().Add(2*time.Minute))
+	assert.Error(t, mapping.Reload())
+	assert.NoError(t, mapping.Allow(&Job{Id: "other"}, "any-role"), "The previous mapping is kept when the file is invalid")
+}